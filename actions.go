@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Functions here are shared by HTTP API and
+// TCP protocol. They return HTTP status code
+// and answer to send
+
+// sendMessage sends message from user with fromID
+// to peer or group and counts it in metrics
+func sendMessage(l *logger, fromID string, req SendMessageRequest) (int, Answer) {
+	code, ans := doSendMessage(l, fromID, req)
+	countSend(req, code, ans)
+	return code, ans
+}
+
+func doSendMessage(l *logger, fromID string, req SendMessageRequest) (int, Answer) {
+	from, found, err := store.GetUserByID(fromID)
+	if err == nil && !found {
+		err = fmt.Errorf("user %s of session not found", fromID)
+	}
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	if req.GroupID != "" {
+		return sendGroupMessage(l, from, req)
+	}
+	us, found, err := store.GetUserByName(req.PeerName)
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	} else if !found {
+		return 404, Answer{false, codeUserNotFound, "User with this name not found", nil}
+	}
+	// don't send messages if user sent it
+	if us.ID == fromID {
+		return 200, Answer{true, "", "", nil}
+	}
+	// sender shouldn't know they're blocked, so
+	// message is dropped like it's queued
+	if blocked, err := isBlocked(fromID, us.ID); err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	} else if blocked {
+		return 202, Answer{true, "", "", SendMessageResult{Status: "queued", dropped: true}}
+	}
+	sm, err := saveMessage(from, us, req.Message)
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	if c, ok := conns.Get(us.ID); ok {
+		if _, err := c.Write(Message{
+			ID:      sm.ID,
+			From:    sm.FromName,
+			Message: sm.Message,
+			Time:    sm.Created,
+		}.ToJSON()); err == nil {
+			return 200, Answer{true, "", "", SendMessageResult{Status: "delivered"}}
+		}
+	}
+	if ok, err := queueMessage(sm); err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	} else if !ok {
+		// message is saved before delivery, so receipt of
+		// it can't come first; it isn't sent, so it
+		// shouldn't stay in history
+		if err := store.DeleteMessage(sm.ID); err != nil {
+			l.Error("deleting unsent message", "err", err)
+		}
+		return 410, Answer{false, codeQueueFull, "User is offline and has too many queued messages", nil}
+	}
+	// peer could connect and flush queue after
+	// conns.Get above, but before message was queued
+	if c, ok := conns.Get(us.ID); ok {
+		if err := flushTo(us.ID, c); err != nil {
+			l.Error("flushing queue", "err", err)
+		}
+	}
+	return 202, Answer{true, "", "", SendMessageResult{Status: "queued"}}
+}
+
+// ack sets receipts of messages sent to user with toID
+// and notifies senders who are online
+func ack(l *logger, toID string, req AckRequest) (int, Answer) {
+	to, found, err := store.GetUserByID(toID)
+	if err == nil && !found {
+		err = fmt.Errorf("user %s of session not found", toID)
+	}
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	now := time.Now()
+	list, err := store.SetReceipt(toID, req.IDs, req.Status, now)
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	for _, m := range list {
+		if c, ok := conns.Get(m.From); ok {
+			c.Write(Receipt{
+				ID:     m.ID,
+				Peer:   to.Name,
+				Status: req.Status,
+				Time:   now,
+			}.ToJSON())
+		}
+	}
+	return 200, Answer{true, "", "", nil}
+}
+
+// isOnline tells user with viewerID if
+// user with name is online
+func isOnline(l *logger, viewerID, name string) (int, Answer) {
+	us, found, err := store.GetUserByName(name)
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	if !found {
+		return 200, Answer{true, "", "", IsOnlineResult{false, false, nil}}
+	}
+	p, err := presenceOf(viewerID, us)
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	return 200, Answer{true, "", "", IsOnlineResult{p.Online, true, p.LastSeen}}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// userRoleAdmin is role of users who can use /admin
+const userRoleAdmin = "admin"
+
+// limits of pages of /admin/users and /admin/audit
+const (
+	defaultUsersLimit = 50
+	maxUsersLimit     = 100
+	defaultAuditLimit = 50
+	maxAuditLimit     = 100
+)
+
+// admin actions in audit log
+const (
+	auditDisable    = "disable"
+	auditEnable     = "enable"
+	auditDelete     = "delete"
+	auditDisconnect = "disconnect"
+	auditResetPass  = "reset_password"
+	auditSetRole    = "set_role"
+	// made by commands only
+	auditCreate = "create"
+	auditRevoke = "revoke_sessions"
+)
+
+// isAdmin tells if user has admin role
+// or is listed in admin.users of config
+func isAdmin(us User) bool {
+	if us.Role == userRoleAdmin {
+		return true
+	}
+	for _, name := range conf.Admin.Users {
+		if name == us.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeAdmin checks that request is made by admin
+// and writes error answer if it isn't
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) (User, bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return User{}, false
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return User{}, false
+	}
+	admin, found, err := store.GetUserByID(sess.UserID)
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return User{}, false
+	} else if !found || !isAdmin(admin) {
+		w.WriteHeader(403)
+		writeAnswer(w, Answer{false, codeAdminRequired, "Admin rights required", nil})
+		return User{}, false
+	}
+	return admin, true
+}
+
+// adminTarget authorizes admin and finds user
+// the request is about
+func adminTarget(w http.ResponseWriter, r *http.Request) (User, User, AdminUserRequest, bool) {
+	var req AdminUserRequest
+	admin, ok := authorizeAdmin(w, r)
+	if !ok || !readJSON(w, r, &req) {
+		return admin, User{}, req, false
+	}
+	us, found, err := store.GetUserByName(req.Name)
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return admin, us, req, false
+	} else if !found {
+		w.WriteHeader(404)
+		writeAnswer(w, Answer{false, codeUserNotFound, "User with this name not found", nil})
+		return admin, us, req, false
+	}
+	return admin, us, req, true
+}
+
+// audit writes admin action to audit log; it isn't
+// critical for action, so errors are only logged
+func audit(l *logger, admin User, action string, target User, details string) {
+	l.Info("admin action", "admin", admin.Name, "action", action, "target", target.Name)
+	if err := store.AddAudit(AuditEntry{
+		ID:        newMessageID(),
+		AdminID:   admin.ID,
+		AdminName: admin.Name,
+		Action:    action,
+		TargetID:  target.ID,
+		Target:    target.Name,
+		Details:   details,
+		Time:      time.Now(),
+	}); err != nil {
+		l.Error("writing audit log", "err", err)
+	}
+}
+
+// kick closes user's connection if user is online
+func kick(userID string) bool {
+	c, ok := conns.Get(userID)
+	if !ok {
+		return false
+	}
+	c.Write(Event{Type: evDisconnected}.ToJSON())
+	conns.Remove(userID, c)
+	c.Close()
+	return true
+}
+
+// AdminUsersHandler lists users or searches them by name
+func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorizeAdmin(w, r); !ok {
+		return
+	}
+	var req AdminUsersRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultUsersLimit
+	} else if req.Limit > maxUsersLimit {
+		req.Limit = maxUsersLimit
+	}
+	list, err := store.ListUsers(req.Query, req.After, req.Limit)
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	var res = AdminUsersResult{Users: make([]AdminUser, len(list))}
+	for i, us := range list {
+		_, online := conns.Get(us.ID)
+		res.Users[i] = AdminUser{
+			ID:       us.ID,
+			Name:     us.Name,
+			Role:     us.Role,
+			Disabled: us.Disabled,
+			Online:   online,
+			LastSeen: us.LastSeen,
+		}
+	}
+	if len(list) == req.Limit {
+		res.Next = list[len(list)-1].Name
+	}
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", res})
+}
+
+// AdminDisableHandler disables user: sessions
+// are deleted and new ones can't be created
+func AdminDisableHandler(w http.ResponseWriter, r *http.Request) {
+	setDisabled(w, r, true)
+}
+
+// AdminEnableHandler enables disabled user
+func AdminEnableHandler(w http.ResponseWriter, r *http.Request) {
+	setDisabled(w, r, false)
+}
+
+func setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	admin, us, _, ok := adminTarget(w, r)
+	if !ok {
+		return
+	} else if us.ID == admin.ID {
+		w.WriteHeader(400)
+		writeAnswer(w, Answer{false, codeSelfAction, "Can't disable yourself", nil})
+		return
+	}
+	if err := store.SetUserDisabled(us.ID, disabled); err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	action := auditEnable
+	if disabled {
+		action = auditDisable
+		if err := store.DeleteSessions(us.ID); err != nil {
+			w.WriteHeader(500)
+			reqLog(r).Error("server-side error", "err", err)
+			writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+			return
+		}
+		kick(us.ID)
+	}
+	audit(reqLog(r), admin, action, us, "")
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", nil})
+}
+
+// AdminDeleteUserHandler deletes user and removes
+// user from groups; history is kept
+func AdminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	admin, us, _, ok := adminTarget(w, r)
+	if !ok {
+		return
+	} else if us.ID == admin.ID {
+		w.WriteHeader(400)
+		writeAnswer(w, Answer{false, codeSelfAction, "Can't delete yourself", nil})
+		return
+	}
+	if err := deleteUser(us); err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	kick(us.ID)
+	audit(reqLog(r), admin, auditDelete, us, "")
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", nil})
+}
+
+// deleteUser removes user from groups and deletes
+// user with sessions, queue and lists
+func deleteUser(us User) error {
+	groups, err := store.GroupsOf(us.ID)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		code, ans := changeGroup(lg, g.ID, us.ID, func(g *Group, i int) (int, Answer) {
+			removeMember(g, i)
+			return 200, Answer{true, "", "", nil}
+		})
+		// group can be left or deleted meanwhile
+		if !ans.Success && code != 404 {
+			return errors.New(ans.Error)
+		}
+	}
+	return store.DeleteUser(us.ID)
+}
+
+// AdminDisconnectHandler closes user's connection
+func AdminDisconnectHandler(w http.ResponseWriter, r *http.Request) {
+	admin, us, _, ok := adminTarget(w, r)
+	if !ok {
+		return
+	}
+	if !kick(us.ID) {
+		w.WriteHeader(404)
+		writeAnswer(w, Answer{false, codePeerOffline, "User is offline", nil})
+		return
+	}
+	audit(reqLog(r), admin, auditDisconnect, us, "")
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", nil})
+}
+
+// AdminResetPasswordHandler sets new password of
+// user and deletes user's sessions; password is
+// generated if it isn't given
+func AdminResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	admin, us, req, ok := adminTarget(w, r)
+	if !ok {
+		return
+	}
+	if req.Pass == "" {
+		var err error
+		if req.Pass, err = randomPass(); err != nil {
+			w.WriteHeader(500)
+			reqLog(r).Error("server-side error", "err", err)
+			writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+			return
+		}
+	}
+	if err := resetPass(us, req.Pass); err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	kick(us.ID)
+	audit(reqLog(r), admin, auditResetPass, us, "")
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", PassResult{req.Pass}})
+}
+
+// randomPass generates password for
+// reset or account made from command line
+func randomPass() (string, error) {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// resetPass sets new password of user and
+// deletes user's sessions
+func resetPass(us User, pass string) error {
+	hash, err := hashPass(pass)
+	if err != nil {
+		return err
+	}
+	if err := store.SetUserHash(us.ID, hash); err != nil {
+		return err
+	}
+	passSucceeded(us.ID)
+	return store.DeleteSessions(us.ID)
+}
+
+// AdminSetRoleHandler sets role of user;
+// it's "admin" or empty
+func AdminSetRoleHandler(w http.ResponseWriter, r *http.Request) {
+	admin, us, req, ok := adminTarget(w, r)
+	if !ok {
+		return
+	} else if req.Role != "" && req.Role != userRoleAdmin {
+		w.WriteHeader(400)
+		writeAnswer(w, Answer{false, codeInvalidField, `role should be "admin" or empty`, nil})
+		return
+	} else if us.ID == admin.ID {
+		w.WriteHeader(400)
+		writeAnswer(w, Answer{false, codeSelfAction, "Can't change own role", nil})
+		return
+	}
+	if err := store.SetUserRole(us.ID, req.Role); err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	audit(reqLog(r), admin, auditSetRole, us, req.Role)
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", nil})
+}
+
+// AdminAuditHandler returns audit log, newest first
+func AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := authorizeAdmin(w, r); !ok {
+		return
+	}
+	var req AuditRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultAuditLimit
+	} else if req.Limit > maxAuditLimit {
+		req.Limit = maxAuditLimit
+	}
+	list, err := store.AuditLog(req.Before, req.Limit)
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	var res = AuditResult{Entries: list}
+	if len(list) == req.Limit {
+		res.Next = list[len(list)-1].ID
+	}
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", res})
+}
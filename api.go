@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiV1 is prefix of versioned routes. Answers of them
+// have "success" key and code of error; unversioned
+// routes keep legacy answers ("succes" key, message
+// only) for old clients
+const apiV1 = "/v1"
+
+// isV1 tells if request is made to versioned route
+func isV1(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiV1+"/")
+}
+
+// apiRoute returns route without version prefix,
+// so limits of route are same for both versions
+func apiRoute(path string) string {
+	if strings.HasPrefix(path, apiV1+"/") {
+		return strings.TrimPrefix(path, apiV1)
+	}
+	return path
+}
+
+// codes of errors; they're given to
+// Answer where error is made
+const (
+	codeInternal         = "internal_error"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeUnsupportedType  = "unsupported_content_type"
+	codeInvalidJSON      = "invalid_json"
+	codeEmptyBody        = "empty_body"
+	codeBodyTooLarge     = "body_too_large"
+	codeMissingToken     = "missing_token"
+	codeInvalidToken     = "invalid_token"
+	codeAccountDisabled  = "account_disabled"
+	codeAdminRequired    = "admin_required"
+	codeRateLimited      = "rate_limited"
+	codeLockedOut        = "locked_out"
+	codeUnavailable      = "unavailable"
+	codeNotReady         = "not_ready"
+	codeMissingField     = "missing_field"
+	codeInvalidField     = "invalid_field"
+	codeTooShort         = "too_short"
+	codeTooLong          = "too_long"
+	codeInvalidCharset   = "invalid_charset"
+	codeUnknownCommand   = "unknown_command"
+	codeInvalidName      = "invalid_name"
+	codeNameTaken        = "name_taken"
+	codePassNotAllowed   = "pass_not_allowed"
+	codeWrongPassword    = "wrong_password"
+	codeUserNotFound     = "user_not_found"
+	codePeerOffline      = "peer_offline"
+	codeNotConnected     = "not_connected"
+	codeQueueFull        = "queue_full"
+	codeSessionNotFound  = "session_not_found"
+	codeListFull         = "list_full"
+	codeGroupNotFound    = "group_not_found"
+	codeNotMember        = "not_member"
+	codeAlreadyMember    = "already_member"
+	codeNotEnoughRights  = "not_enough_rights"
+	codeSelfAction       = "self_action"
+	codeConflict         = "conflict"
+)
+
+// errorCodes are all codes above, for OpenAPI document
+var errorCodes = []string{
+	codeInternal, codeMethodNotAllowed, codeUnsupportedType, codeInvalidJSON,
+	codeEmptyBody, codeBodyTooLarge, codeMissingToken, codeInvalidToken,
+	codeAccountDisabled, codeAdminRequired, codeRateLimited, codeLockedOut,
+	codeUnavailable, codeNotReady, codeMissingField, codeInvalidField,
+	codeTooShort, codeTooLong, codeInvalidCharset, codeUnknownCommand,
+	codeInvalidName, codeNameTaken, codePassNotAllowed, codeWrongPassword,
+	codeUserNotFound, codePeerOffline, codeNotConnected, codeQueueFull,
+	codeSessionNotFound, codeListFull, codeGroupNotFound, codeNotMember,
+	codeAlreadyMember, codeNotEnoughRights, codeSelfAction, codeConflict,
+}
+
+// statusCodes are codes of errors made without
+// code; they're given by HTTP status
+var statusCodes = map[int]string{
+	400: "bad_request",
+	401: "unauthorized",
+	403: "forbidden",
+	404: "not_found",
+	405: "method_not_allowed",
+	409: "conflict",
+	410: "gone",
+	413: "too_large",
+	415: "unsupported_content_type",
+	429: "rate_limited",
+	500: "internal_error",
+	503: "unavailable",
+}
+
+// V1Answer is answer of /v1 routes
+type V1Answer struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code,omitempty"`
+	Error   string `json:"error,omitempty"`
+	Res     Result `json:"result,omitempty"`
+}
+
+// v1Writer is writer of /v1 requests; it remembers
+// status, so error without code gets one by it
+type v1Writer struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *v1Writer) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// writeAnswer writes answer as V1Answer to /v1
+// requests and as legacy Answer to other ones
+func writeAnswer(w http.ResponseWriter, a Answer) {
+	vw, ok := w.(*v1Writer)
+	if !ok {
+		w.Write(a.ToJSON())
+		return
+	}
+	ans := V1Answer{Success: a.Success, Code: a.Code, Error: a.Error, Res: a.Res}
+	if !ans.Success && ans.Code == "" {
+		if ans.Code = statusCodes[vw.status]; ans.Code == "" {
+			ans.Code = "error"
+		}
+	}
+	res, err := json.Marshal(ans)
+	if err != nil {
+		lg.Error("answer2json", "err", err)
+		res = []byte(`{"success":false,"code":"internal_error","error":"server error"}`)
+	}
+	w.Write(res)
+}
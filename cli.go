@@ -0,0 +1,293 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// command is subcommand of binary; run
+// gets arguments after command's name
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) bool
+}
+
+// commandNames are in order of usage
+var commandNames = []string{
+	"serve",
+	"user create",
+	"user delete",
+	"user reset-password",
+	"sessions revoke",
+	"db migrate",
+	"config check",
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve": {"", "start server (default)", func([]string) bool {
+			return runServer()
+		}},
+		"user create":         {"[-admin] [-pass PASS] NAME", "create user; password is generated if it isn't given", userCreateCmd},
+		"user delete":         {"NAME", "delete user", userDeleteCmd},
+		"user reset-password": {"[-pass PASS] NAME", "set new password and revoke sessions", userResetPassCmd},
+		"sessions revoke":     {"[-id ID] NAME", "revoke all sessions of user or one with id", sessionsRevokeCmd},
+		"db migrate":          {"", "create indexes and hash legacy plaintext passwords", dbMigrateCmd},
+		"config check":        {"", "check config and certificates", configCheckCmd},
+	}
+}
+
+// runCommand runs subcommand named by first
+// (or first two) of args; it's serve if args
+// are empty. It returns false if command failed
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return runServer()
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage()
+		return true
+	}
+	if len(args) > 1 {
+		if c, ok := commands[args[0]+" "+args[1]]; ok {
+			return c.run(args[2:])
+		}
+	}
+	if c, ok := commands[args[0]]; ok {
+		return c.run(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", strings.Join(args, " "))
+	printUsage()
+	return false
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: overmsg-server [command]\n\nCommands:")
+	for _, name := range commandNames {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-40s %s\n", strings.TrimSpace(name+" "+c.usage), c.help)
+	}
+}
+
+// cliFail prints error of command
+func cliFail(format string, a ...interface{}) bool {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", a...)
+	return false
+}
+
+// cliAdmin is author of audit entries made by commands
+var cliAdmin = User{Name: "cli"}
+
+// parseArgs parses flags of command and
+// returns its only positional argument
+func parseArgs(fs *flag.FlagSet, args []string, usage string) (string, bool) {
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: overmsg-server %s %s\n", fs.Name(), usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", false
+	} else if fs.NArg() != 1 {
+		fs.Usage()
+		return "", false
+	}
+	return fs.Arg(0), true
+}
+
+// openPersistentStore loads config and opens store;
+// memory store is refused, because changes
+// would be lost right after command
+func openPersistentStore() bool {
+	if !loadConfig() {
+		return false
+	} else if conf.Store.Type == storeMemory {
+		return cliFail("store.type is %q; there is nothing to manage", storeMemory)
+	}
+	return openStore()
+}
+
+// cliUser finds user by name for command
+func cliUser(name string) (User, bool) {
+	us, found, err := store.GetUserByName(name)
+	if err != nil {
+		return us, cliFail("%v", err)
+	} else if !found {
+		return us, cliFail("user %q not found", name)
+	}
+	return us, true
+}
+
+func userCreateCmd(args []string) bool {
+	fs := flag.NewFlagSet("user create", flag.ContinueOnError)
+	admin := fs.Bool("admin", false, "give admin role")
+	pass := fs.String("pass", "", "password")
+	name, ok := parseArgs(fs, args, commands["user create"].usage)
+	if !ok || !openPersistentStore() {
+		return false
+	}
+	defer store.Close(ctx)
+	generated := *pass == ""
+	if generated {
+		var err error
+		if *pass, err = randomPass(); err != nil {
+			return cliFail("%v", err)
+		}
+	}
+	req := RegRequest{Name: name, Pass: *pass}
+	if _, ans := validate(&req); !ans.Success {
+		return cliFail("%s", ans.Error)
+	}
+	var role string
+	if *admin {
+		role = userRoleAdmin
+	}
+	us, _, ans := createUser(lg, req.Name, req.Pass, role)
+	if !ans.Success {
+		return cliFail("%s", ans.Error)
+	}
+	audit(lg, cliAdmin, auditCreate, us, role)
+	fmt.Printf("created user %s (id %s)\n", us.Name, us.ID)
+	if generated {
+		fmt.Println("password:", *pass)
+	}
+	return true
+}
+
+func userDeleteCmd(args []string) bool {
+	fs := flag.NewFlagSet("user delete", flag.ContinueOnError)
+	name, ok := parseArgs(fs, args, commands["user delete"].usage)
+	if !ok || !openPersistentStore() {
+		return false
+	}
+	defer store.Close(ctx)
+	us, ok := cliUser(name)
+	if !ok {
+		return false
+	}
+	if err := deleteUser(us); err != nil {
+		return cliFail("%v", err)
+	}
+	audit(lg, cliAdmin, auditDelete, us, "")
+	fmt.Println("deleted user", us.Name)
+	return true
+}
+
+func userResetPassCmd(args []string) bool {
+	fs := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+	pass := fs.String("pass", "", "new password")
+	name, ok := parseArgs(fs, args, commands["user reset-password"].usage)
+	if !ok || !openPersistentStore() {
+		return false
+	}
+	defer store.Close(ctx)
+	us, ok := cliUser(name)
+	if !ok {
+		return false
+	}
+	generated := *pass == ""
+	if generated {
+		var err error
+		if *pass, err = randomPass(); err != nil {
+			return cliFail("%v", err)
+		}
+	} else if _, ans := validate(&AdminUserRequest{Name: us.Name, Pass: *pass}); !ans.Success {
+		return cliFail("%s", ans.Error)
+	}
+	if err := resetPass(us, *pass); err != nil {
+		return cliFail("%v", err)
+	}
+	audit(lg, cliAdmin, auditResetPass, us, "")
+	fmt.Println("password of", us.Name, "is reset; sessions are revoked")
+	if generated {
+		fmt.Println("password:", *pass)
+	}
+	return true
+}
+
+func sessionsRevokeCmd(args []string) bool {
+	fs := flag.NewFlagSet("sessions revoke", flag.ContinueOnError)
+	id := fs.String("id", "", "id of session to revoke")
+	name, ok := parseArgs(fs, args, commands["sessions revoke"].usage)
+	if !ok || !openPersistentStore() {
+		return false
+	}
+	defer store.Close(ctx)
+	us, ok := cliUser(name)
+	if !ok {
+		return false
+	}
+	if *id != "" {
+		if found, err := store.DeleteSession(*id, us.ID); err != nil {
+			return cliFail("%v", err)
+		} else if !found {
+			return cliFail("session %s of %s not found", *id, us.Name)
+		}
+		audit(lg, cliAdmin, auditRevoke, us, *id)
+		fmt.Println("revoked session", *id)
+		return true
+	}
+	if err := store.DeleteSessions(us.ID); err != nil {
+		return cliFail("%v", err)
+	}
+	audit(lg, cliAdmin, auditRevoke, us, "all")
+	fmt.Println("revoked all sessions of", us.Name)
+	return true
+}
+
+// migrateBatch is count of users read
+// at once by db migrate
+const migrateBatch = 100
+
+func dbMigrateCmd(args []string) bool {
+	if len(args) != 0 {
+		return cliFail("db migrate takes no arguments")
+	}
+	// indexes are created by openStore
+	if !openPersistentStore() {
+		return false
+	}
+	defer store.Close(ctx)
+	var after string
+	var n int
+	for {
+		list, err := store.ListUsers("", after, migrateBatch)
+		if err != nil {
+			return cliFail("%v", err)
+		}
+		for _, us := range list {
+			if us.Hash != "" || us.Pass == "" {
+				continue
+			}
+			hash, err := hashPass(us.Pass)
+			if err != nil {
+				return cliFail("%v", err)
+			}
+			if err := store.SetUserHash(us.ID, hash); err != nil {
+				return cliFail("%v", err)
+			}
+			n++
+		}
+		if len(list) < migrateBatch {
+			break
+		}
+		after = list[len(list)-1].Name
+	}
+	fmt.Printf("indexes are created; hashed %d legacy password(s)\n", n)
+	return true
+}
+
+func configCheckCmd(args []string) bool {
+	if len(args) != 0 {
+		return cliFail("config check takes no arguments")
+	}
+	if !loadConfig() {
+		return false
+	}
+	fmt.Println("config is OK")
+	return true
+}
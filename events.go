@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// types of ephemeral events
+const (
+	evTypingStarted  = "typing_started"
+	evTypingStopped  = "typing_stopped"
+	evPresence       = "presence"
+	evSessionRevoked = "session_revoked"
+	evShutdown       = "shutdown"
+	evDisconnected   = "disconnected"
+)
+
+// typingInterval is min interval between typing_started
+// events from one user to one peer or group
+const typingInterval = 3 * time.Second
+
+// Event is envelope of ephemeral events pushed to
+// connections. Unlike messages they aren't stored,
+// so offline users never get them
+type Event struct {
+	Type  string    `json:"type"`
+	From  string    `json:"from_name,omitempty"`
+	Group string    `json:"group_id,omitempty"`
+	Time  time.Time `json:"time"`
+	// Online is set for presence events
+	Online *bool `json:"online,omitempty"`
+}
+
+// ToJSON returns encoded event
+// as bytes
+func (e Event) ToJSON() []byte {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	res, err := json.Marshal(e)
+	if err != nil {
+		lg.Error("event2json", "err", err)
+		return []byte(`{"type":"` + e.Type + `","error":"Error of encoding"}` + "\n")
+	}
+	return append(res, '\n')
+}
+
+// push writes event to user's connection if user is online
+func push(userID string, e Event) bool {
+	c, ok := conns.Get(userID)
+	if !ok {
+		return false
+	}
+	_, err := c.Write(e.ToJSON())
+	return err == nil
+}
+
+// typingThrottle remembers when typing_started
+// events were sent last time
+var typingThrottle = struct {
+	sync.Mutex
+	last   map[string]time.Time
+	pruned time.Time
+}{last: make(map[string]time.Time)}
+
+// allowTyping tells if event from user to target can be
+// sent now. typing_stopped is always allowed and resets
+// throttling, so next typing_started goes immediately
+func allowTyping(fromID, target string, started bool) bool {
+	key := fromID + "\x00" + target
+	now := time.Now()
+	typingThrottle.Lock()
+	defer typingThrottle.Unlock()
+	if now.Sub(typingThrottle.pruned) > time.Minute {
+		for k, t := range typingThrottle.last {
+			if now.Sub(t) > typingInterval {
+				delete(typingThrottle.last, k)
+			}
+		}
+		typingThrottle.pruned = now
+	}
+	if !started {
+		delete(typingThrottle.last, key)
+		return true
+	}
+	if t, ok := typingThrottle.last[key]; ok && now.Sub(t) < typingInterval {
+		return false
+	}
+	typingThrottle.last[key] = now
+	return true
+}
+
+// typing sends typing state of user with fromID
+// to peer or to online members of group
+func typing(l *logger, fromID string, req TypingRequest) (int, Answer) {
+	from, found, err := store.GetUserByID(fromID)
+	if err != nil || !found {
+		l.Error("getting user of session", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	var (
+		e       = Event{Type: evTypingStopped, From: from.Name}
+		targets []string
+		key     string
+	)
+	if req.Typing {
+		e.Type = evTypingStarted
+	}
+	if req.GroupID != "" {
+		g, _, code, ans := loadGroup(l, req.GroupID, fromID)
+		if !ans.Success {
+			return code, ans
+		}
+		blocked, err := blockers(fromID)
+		if err != nil {
+			l.Error("server-side error", "err", err)
+			return 500, Answer{false, codeInternal, "Server-side error", nil}
+		}
+		e.Group, key = g.ID, g.ID
+		for _, m := range g.Members {
+			if m.UserID != fromID && !blocked[m.UserID] {
+				targets = append(targets, m.UserID)
+			}
+		}
+	} else {
+		us, found, err := store.GetUserByName(req.PeerName)
+		if err != nil {
+			l.Error("server-side error", "err", err)
+			return 500, Answer{false, codeInternal, "Server-side error", nil}
+		} else if !found {
+			return 404, Answer{false, codeUserNotFound, "User with this name not found", nil}
+		}
+		if blocked, err := isBlocked(fromID, us.ID); err != nil {
+			l.Error("server-side error", "err", err)
+			return 500, Answer{false, codeInternal, "Server-side error", nil}
+		} else if blocked {
+			// looks like throttled one
+			return 200, Answer{true, "", "", TypingResult{false}}
+		}
+		targets, key = []string{us.ID}, us.ID
+	}
+	if !allowTyping(fromID, key, req.Typing) {
+		return 200, Answer{true, "", "", TypingResult{false}}
+	}
+	for _, id := range targets {
+		push(id, e)
+	}
+	return 200, Answer{true, "", "", TypingResult{true}}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	roleOwner  = "owner"
+	roleAdmin  = "admin"
+	roleMember = "member"
+
+	// maxGroupTries is count of tries to change group
+	// which other requests change at same time
+	maxGroupTries = 10
+)
+
+// member returns index of user in group's
+// members or -1 if user isn't member
+func (g Group) member(userID string) int {
+	for i, m := range g.Members {
+		if m.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// memberByName returns index of user with name
+// in group's members or -1 if user isn't member
+func (g Group) memberByName(name string) int {
+	for i, m := range g.Members {
+		if m.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// loadGroup returns group where user is member
+// and index of user in members
+func loadGroup(l *logger, groupID, userID string) (Group, int, int, Answer) {
+	if strings.TrimSpace(groupID) == "" {
+		return Group{}, -1, 400, Answer{false, codeMissingField, "Empty group_id", nil}
+	}
+	g, found, err := store.GetGroup(groupID)
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return g, -1, 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	i := g.member(userID)
+	// non-members shouldn't know if group exists
+	if !found || i < 0 {
+		return g, -1, 404, Answer{false, codeGroupNotFound, "Group not found", nil}
+	}
+	return g, i, 200, Answer{true, "", "", nil}
+}
+
+// blocksMember tells if user with userID blocked
+// any member of group; such user isn't added to it,
+// else blocked one could reach them through group
+func blocksMember(g Group, userID string) (bool, error) {
+	ids, err := store.List(listBlocked, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		if g.member(id) >= 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeMember removes i-th member from group. Role
+// of owner goes to first admin or first member
+func removeMember(g *Group, i int) {
+	wasOwner := g.Members[i].Role == roleOwner
+	g.Members = append(g.Members[:i], g.Members[i+1:]...)
+	if wasOwner && len(g.Members) != 0 {
+		var next int
+		for k, m := range g.Members {
+			if m.Role == roleAdmin {
+				next = k
+				break
+			}
+		}
+		g.Members[next].Role = roleOwner
+	}
+}
+
+// changeGroup loads group where user with userID is member
+// and applies change to it; change returns error answer to
+// abort. Group is saved only if nobody changed it since it
+// was loaded, else it's loaded and changed again. Group
+// left without members is deleted. Answer has changed group
+func changeGroup(l *logger, groupID, userID string, change func(g *Group, i int) (int, Answer)) (int, Answer) {
+	for try := 0; try < maxGroupTries; try++ {
+		g, i, code, ans := loadGroup(l, groupID, userID)
+		if !ans.Success {
+			return code, ans
+		} else if code, ans = change(&g, i); !ans.Success {
+			return code, ans
+		}
+		ok, err := store.UpdateGroup(g)
+		if err == nil && ok && len(g.Members) == 0 {
+			err = store.DeleteGroup(g.ID)
+		}
+		if err != nil {
+			l.Error("server-side error", "err", err)
+			return 500, Answer{false, codeInternal, "Server-side error", nil}
+		} else if ok {
+			return 200, Answer{true, "", "", GroupResult{g}}
+		}
+	}
+	l.Warn("group is changed too often", "group_id", groupID)
+	return 409, Answer{false, codeConflict, "Group is changed by other request; try again", nil}
+}
+
+// sendGroupMessage saves message to group and writes
+// it to connections of online members
+func sendGroupMessage(l *logger, from User, req SendMessageRequest) (int, Answer) {
+	g, _, code, ans := loadGroup(l, req.GroupID, from.ID)
+	if !ans.Success {
+		return code, ans
+	}
+	sm := StoredMessage{
+		ID:       newMessageID(),
+		From:     from.ID,
+		FromName: from.Name,
+		Group:    g.ID,
+		Message:  req.Message,
+		Created:  time.Now(),
+	}
+	if err := store.SaveMessage(sm); err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	msg := Message{
+		ID:      sm.ID,
+		From:    sm.FromName,
+		Group:   g.ID,
+		Message: sm.Message,
+		Time:    sm.Created,
+	}.ToJSON()
+	blocked, err := blockers(from.ID)
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	var delivered int
+	for _, m := range g.Members {
+		if m.UserID == from.ID || blocked[m.UserID] {
+			continue
+		}
+		if c, ok := conns.Get(m.UserID); ok {
+			if _, err := c.Write(msg); err == nil {
+				delivered++
+			}
+		}
+	}
+	return 200, Answer{true, "", "", SendMessageResult{Status: "sent", Delivered: delivered}}
+}
+
+// GroupsHandler returns list of user's groups
+func GroupsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	list, err := store.GroupsOf(sess.UserID)
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", GroupsResult{list}})
+}
+
+// CreateGroupHandler creates group where
+// user is owner
+func CreateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	var req CreateGroupRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	owner, found, err := store.GetUserByID(sess.UserID)
+	if err != nil || !found {
+		w.WriteHeader(500)
+		reqLog(r).Error("getting owner of group", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	g := Group{
+		ID:      uuid.New().String(),
+		Name:    req.Name,
+		Created: time.Now(),
+		Members: []GroupMember{{owner.ID, owner.Name, roleOwner}},
+	}
+	for _, name := range req.Members {
+		us, found, err := store.GetUserByName(name)
+		if err != nil {
+			w.WriteHeader(500)
+			reqLog(r).Error("server-side error", "err", err)
+			writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+			return
+		} else if !found {
+			w.WriteHeader(404)
+			writeAnswer(w, Answer{false, codeUserNotFound, "User " + name + " not found", nil})
+			return
+		} else if g.member(us.ID) < 0 {
+			g.Members = append(g.Members, GroupMember{us.ID, us.Name, roleMember})
+		}
+	}
+	// it's checked after all members are known, so order
+	// of names doesn't matter; creator shouldn't know
+	// they're blocked, so it looks like unknown user
+	for _, m := range g.Members[1:] {
+		if blocks, err := blocksMember(g, m.UserID); err != nil {
+			w.WriteHeader(500)
+			reqLog(r).Error("server-side error", "err", err)
+			writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+			return
+		} else if blocks {
+			w.WriteHeader(404)
+			writeAnswer(w, Answer{false, codeUserNotFound, "User " + m.Name + " not found", nil})
+			return
+		}
+	}
+	if err := store.CreateGroup(g); err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	w.WriteHeader(201)
+	writeAnswer(w, Answer{true, "", "", GroupResult{g}})
+}
+
+// InviteToGroupHandler adds user to group;
+// only owner and admins can do it
+func InviteToGroupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	var req GroupMemberRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	l := reqLog(r)
+	code, ans := changeGroup(l, req.GroupID, sess.UserID, func(g *Group, i int) (int, Answer) {
+		if g.Members[i].Role == roleMember {
+			return 403, Answer{false, codeNotEnoughRights, "Only owner and admins can invite", nil}
+		}
+		us, found, err := store.GetUserByName(req.Name)
+		if err != nil {
+			l.Error("server-side error", "err", err)
+			return 500, Answer{false, codeInternal, "Server-side error", nil}
+		} else if !found {
+			return 404, Answer{false, codeUserNotFound, "User with this name not found", nil}
+		} else if g.member(us.ID) >= 0 {
+			return 400, Answer{false, codeAlreadyMember, "User is already member", nil}
+		}
+		if blocks, err := blocksMember(*g, us.ID); err != nil {
+			l.Error("server-side error", "err", err)
+			return 500, Answer{false, codeInternal, "Server-side error", nil}
+		} else if blocks {
+			// like in CreateGroupHandler, block isn't told
+			return 404, Answer{false, codeUserNotFound, "User with this name not found", nil}
+		}
+		g.Members = append(g.Members, GroupMember{us.ID, us.Name, roleMember})
+		return 200, Answer{true, "", "", nil}
+	})
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
+}
+
+// RemoveFromGroupHandler removes user from group;
+// owner can remove anyone, admins only members
+func RemoveFromGroupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	var req GroupMemberRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	code, ans := changeGroup(reqLog(r), req.GroupID, sess.UserID, func(g *Group, i int) (int, Answer) {
+		j := g.memberByName(req.Name)
+		if j < 0 {
+			return 404, Answer{false, codeNotMember, "User is not member", nil}
+		} else if j == i {
+			return 400, Answer{false, codeSelfAction, "Use leave_group to leave group", nil}
+		} else if g.Members[i].Role == roleMember ||
+			(g.Members[i].Role == roleAdmin && g.Members[j].Role != roleMember) {
+			return 403, Answer{false, codeNotEnoughRights, "Not enough rights", nil}
+		}
+		g.Members = append(g.Members[:j], g.Members[j+1:]...)
+		return 200, Answer{true, "", "", nil}
+	})
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
+}
+
+// LeaveGroupHandler removes user from group. If owner leaves,
+// ownership goes to first admin (or first member);
+// group is deleted when last member leaves
+func LeaveGroupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	var req GroupRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	code, ans := changeGroup(reqLog(r), req.GroupID, sess.UserID, func(g *Group, i int) (int, Answer) {
+		removeMember(g, i)
+		return 200, Answer{true, "", "", nil}
+	})
+	if ans.Success {
+		// user isn't member any more
+		ans.Res = nil
+	}
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
+}
+
+// RenameGroupHandler renames group;
+// only owner and admins can do it
+func RenameGroupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	var req RenameGroupRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	code, ans := changeGroup(reqLog(r), req.GroupID, sess.UserID, func(g *Group, i int) (int, Answer) {
+		if g.Members[i].Role == roleMember {
+			return 403, Answer{false, codeNotEnoughRights, "Only owner and admins can rename group", nil}
+		}
+		g.Name = req.Name
+		return 200, Answer{true, "", "", nil}
+	})
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
+}
+
+// GroupRoleHandler sets role of member; only owner can do it.
+// Setting owner role passes ownership, so old owner becomes admin
+func GroupRoleHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	var req GroupRoleRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	code, ans := changeGroup(reqLog(r), req.GroupID, sess.UserID, func(g *Group, i int) (int, Answer) {
+		if g.Members[i].Role != roleOwner {
+			return 403, Answer{false, codeNotEnoughRights, "Only owner can set roles", nil}
+		}
+		switch req.Role {
+		case roleOwner, roleAdmin, roleMember:
+		default:
+			return 400, Answer{false, codeInvalidField, `role should be "owner", "admin" or "member"`, nil}
+		}
+		j := g.memberByName(req.Name)
+		if j < 0 {
+			return 404, Answer{false, codeNotMember, "User is not member", nil}
+		} else if j == i {
+			return 400, Answer{false, codeSelfAction, "Pass ownership to other member instead", nil}
+		}
+		if req.Role == roleOwner {
+			g.Members[i].Role = roleAdmin
+		}
+		g.Members[j].Role = req.Role
+		return 200, Answer{true, "", "", nil}
+	})
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestChangeGroupConcurrent(t *testing.T) {
+	store = newMemStore()
+	g := Group{ID: "g", Name: "g", Members: []GroupMember{{"owner", "owner", roleOwner}}}
+	if err := store.CreateGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	const n = 5
+	var wg sync.WaitGroup
+	for k := 0; k < n; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			id := fmt.Sprint("user", k)
+			code, ans := changeGroup(lg, "g", "owner", func(g *Group, i int) (int, Answer) {
+				g.Members = append(g.Members, GroupMember{id, id, roleMember})
+				return 200, Answer{true, "", "", nil}
+			})
+			if !ans.Success && code != 409 {
+				t.Errorf("change %d = %d %s", k, code, ans.Error)
+			}
+		}(k)
+	}
+	wg.Wait()
+	g, _, _ = store.GetGroup("g")
+	// each change is kept or told to be retried
+	if len(g.Members) < 2 || int64(len(g.Members)-1) != g.Version {
+		t.Fatalf("group has %d members after %d updates", len(g.Members), g.Version)
+	}
+}
+
+func TestUpdateGroupStale(t *testing.T) {
+	store = newMemStore()
+	g := Group{ID: "g", Members: []GroupMember{{"owner", "owner", roleOwner}}}
+	if err := store.CreateGroup(g); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := store.UpdateGroup(g); !ok {
+		t.Fatal("update of fresh group failed")
+	}
+	if ok, _ := store.UpdateGroup(g); ok {
+		t.Fatal("update of stale group succeeded")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// started is time when server was started
+var started = time.Now()
+
+// readyChecks are checks of /readyz
+var readyChecks = map[string]func(context.Context) error{
+	"store": func(c context.Context) error {
+		return store.Ping(c)
+	},
+	"tcp_listener": func(context.Context) error {
+		var want int
+		if !conf.TCP.TLS.Only {
+			want++
+		}
+		if conf.TCP.TLS.Enabled() {
+			want++
+		}
+		tcpListeners.Lock()
+		defer tcpListeners.Unlock()
+		if len(tcpListeners.l) < want {
+			return errors.New("not bound yet")
+		}
+		return nil
+	},
+	"shutdown": func(context.Context) error {
+		if isShuttingDown() {
+			return errors.New("server is shutting down")
+		}
+		return nil
+	},
+}
+
+// HealthzHandler tells that process is alive
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", HealthResult{Uptime: int64(time.Since(started).Seconds())}})
+}
+
+// ReadyzHandler tells if server can serve users:
+// it's 503 if any check fails
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	c, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	var (
+		res = HealthResult{
+			Uptime: int64(time.Since(started).Seconds()),
+			Checks: make(map[string]CheckResult, len(readyChecks)),
+		}
+		ans = Answer{true, "", "", nil}
+	)
+	for name, check := range readyChecks {
+		start := time.Now()
+		err := check(c)
+		cr := CheckResult{
+			OK:        err == nil,
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if err != nil {
+			cr.Error = err.Error()
+			ans = Answer{false, codeNotReady, "Not ready", nil}
+		}
+		res.Checks[name] = cr
+	}
+	ans.Res = res
+	if ans.Success {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(503)
+	}
+	writeAnswer(w, ans)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 100
+)
+
+// newMessageID returns new id of message.
+// Ids are ordered by creation time,
+// so they're used as history cursors
+func newMessageID() string {
+	return primitive.NewObjectID().Hex()
+}
+
+// saveMessage stores new message in history
+func saveMessage(from, to User, msg string) (StoredMessage, error) {
+	sm := StoredMessage{
+		ID:       newMessageID(),
+		From:     from.ID,
+		To:       to.ID,
+		FromName: from.Name,
+		ToName:   to.Name,
+		Message:  msg,
+		Created:  time.Now(),
+	}
+	return sm, store.SaveMessage(sm)
+}
+
+// HistoryHandler returns page of conversation with
+// peer or of group, newest messages first
+func HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	peerName := strings.TrimSpace(q.Get("peer"))
+	groupID := strings.TrimSpace(q.Get("group"))
+	if peerName == "" && groupID == "" {
+		w.WriteHeader(400)
+		writeAnswer(w, Answer{false, codeMissingField, "Empty peer", nil})
+		return
+	}
+	before := strings.TrimSpace(q.Get("before"))
+	if before != "" && !primitive.IsValidObjectID(before) {
+		w.WriteHeader(400)
+		writeAnswer(w, Answer{false, codeInvalidField, "before is not valid message id", nil})
+		return
+	}
+	var (
+		limit = defaultHistoryLimit
+		err   error
+	)
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			w.WriteHeader(400)
+			writeAnswer(w, Answer{false, codeInvalidField, "limit should be positive number", nil})
+			return
+		} else if limit > maxHistoryLimit {
+			limit = maxHistoryLimit
+		}
+	}
+	var list []StoredMessage
+	if groupID != "" {
+		g, _, code, ans := loadGroup(reqLog(r), groupID, sess.UserID)
+		if !ans.Success {
+			w.WriteHeader(code)
+			writeAnswer(w, ans)
+			return
+		}
+		list, err = store.GroupHistory(g.ID, before, limit)
+	} else {
+		var (
+			peer  User
+			found bool
+		)
+		peer, found, err = store.GetUserByName(peerName)
+		if err != nil {
+			w.WriteHeader(500)
+			reqLog(r).Error("server-side error", "err", err)
+			writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+			return
+		} else if !found {
+			w.WriteHeader(404)
+			writeAnswer(w, Answer{false, codeUserNotFound, "User with this name not found", nil})
+			return
+		}
+		list, err = store.History(sess.UserID, peer.ID, before, limit)
+	}
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	var res = HistoryResult{Messages: list}
+	if len(list) == limit {
+		res.Next = list[len(list)-1].ID
+	}
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", res})
+}
@@ -3,9 +3,6 @@ package main
 import (
 	"fmt"
 	"github.com/google/uuid"
-	"go.mongodb.org/mongo-driver/bson"
-	"io/ioutil"
-	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -22,7 +19,17 @@ func mw(next http.Handler) http.Handler {
 				fmt.Fprint(w, "Unsupported method")
 				return
 			}
-			next.ServeHTTP(w, r)
+			r = withRequestLog(w, r)
+			code, d := measure(w, r, func(w http.ResponseWriter) {
+				if isV1(r) {
+					w = &v1Writer{ResponseWriter: w}
+				}
+				if rateLimit(w, r) {
+					next.ServeHTTP(w, r)
+				}
+			})
+			reqLog(r).Debug("request", "method", r.Method, "path", r.URL.Path,
+				"code", code, "duration", d, "remote", remoteIP(r))
 		},
 	)
 }
@@ -52,127 +59,83 @@ const allowedSymbols = "QWERTYUIOPASDFGHJKLZXCVBNM" +
 	"0123456789" +
 	"_-"
 
-// RegHandler handles registration
-func RegHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	if r.Method != "POST" {
-		w.WriteHeader(405)
-		w.Write(Answer{false, "Unsupported method", nil}.ToJSON())
-		return
-	} else if r.Header.Get("Content-Type") != "application/json" {
-		w.WriteHeader(415)
-		w.Write(Answer{false, "Unsupported Content-Type", nil}.ToJSON())
-		return
-	}
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-		return
-	}
-	if len([]rune(strings.TrimSpace(string(body)))) == 0 {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Got no data", nil}.ToJSON())
-		return
+// Check checks rules of names and
+// passwords which aren't in tags
+func (req RegRequest) Check() (int, Answer) {
+	if []rune(req.Name)[0] == '_' {
+		return 400, Answer{false, codeInvalidName, "Name shouldn't start with _", nil}
+	} else if req.Name == "admin" && req.Pass == "admin" {
+		return 400, Answer{false, codePassNotAllowed, "no admin-admin allowed here)))", nil}
+	}
+	return 200, Answer{true, "", "", nil}
+}
 
+// Check checks that it isn't admin-admin one
+func (req AuthRequest) Check() (int, Answer) {
+	if req.Name == "admin" && req.Pass == "admin" {
+		return 400, Answer{false, codePassNotAllowed, "no admin-admin allowed here)))", nil}
 	}
-	var req map[string]interface{}
-	if err := json.Unmarshal(body, &req); err != nil {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Invalid JSON data", nil}.ToJSON())
-		return
-	}
-	var name, pass string
-	if elem, ok := req["name"]; !ok {
-		w.WriteHeader(400)
-		w.Write(Answer{false, `Got no "name" field`, nil}.ToJSON())
-		return
-	} else if name, ok = elem.(string); !ok {
-		w.WriteHeader(400)
-		w.Write(Answer{false, `"name" field is not string type`, nil}.ToJSON())
-		return
-	} else if name = strings.TrimSpace(name); len([]rune(name)) <= 3 {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Too short name", nil}.ToJSON())
-		return
-	} else if len([]rune(name)) > 32 {
-		w.WriteHeader(413)
-		w.Write(Answer{false, "Too long name", nil}.ToJSON())
-		return
-	} else if []rune(name)[0] == '_' {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Name shouldn't start with _", nil}.ToJSON())
-		return
+	return 200, Answer{true, "", "", nil}
+}
+
+// createUser creates user with role; name and
+// pass should be checked by validate before
+func createUser(l *logger, name, pass, role string) (User, int, Answer) {
+	if _, found, err := store.GetUserByName(name); err != nil {
+		l.Error("server-side error", "err", err)
+		return User{}, 500, Answer{false, codeInternal, "Server-side error", nil}
+	} else if found {
+		return User{}, 400, Answer{false, codeNameTaken, "Found users with this name", nil}
+	}
+	hash, err := hashPass(pass)
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return User{}, 500, Answer{false, codeInternal, "Server-side error", nil}
 	}
-	var isValid bool = true
-BIG:
-	for _, sym := range []rune(name) {
-		for _, vs := range []rune(allowedSymbols) {
-			if sym == vs {
-				continue BIG
-			}
-		}
-		isValid = false
-		break
+	var us = User{
+		Name: name,
+		Hash: hash,
+		ID:   uuid.New().String(),
+		Role: role,
 	}
-	if !isValid {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Name contains not-allowed symbols. GET /allowed_syms to more ingo", nil}.ToJSON())
-		return
+	if err := store.CreateUser(us); err != nil {
+		l.Error("server-side error", "err", err)
+		return User{}, 500, Answer{false, codeInternal, "Server-side error", nil}
 	}
-	if elem, ok := req["pass"]; !ok {
-		w.WriteHeader(400)
-		w.Write(Answer{false, `Got no "pass" field`, nil}.ToJSON())
-		return
-	} else if pass, ok = elem.(string); !ok {
-		w.WriteHeader(400)
-		w.Write(Answer{false, `"pass" field is not string type`, nil}.ToJSON())
-		return
-	} else if len([]rune(pass)) == 0 {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "pass should be longer", nil}.ToJSON())
-		return
-	} else if len([]rune(pass)) >= 32 {
-		w.WriteHeader(413)
-		w.Write(Answer{false, "pass is TOO long", nil}.ToJSON())
+	return us, 201, Answer{true, "", "", nil}
+}
+
+// RegHandler handles registration
+func RegHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
 		return
 	}
-	if name == "admin" && pass == "admin" {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "no admin-admin allowed here)))", nil}.ToJSON())
+	var req RegRequest
+	if !readJSON(w, r, &req) {
 		return
 	}
-	if rCount, err := loginData.CountDocuments(ctx,
-		bson.M{"name": name}); err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-		return
-	} else if rCount != 0 {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Found users with this name", nil}.ToJSON())
+	newUser, code, ans := createUser(reqLog(r), req.Name, req.Pass, "")
+	if !ans.Success {
+		w.WriteHeader(code)
+		writeAnswer(w, ans)
 		return
 	}
-	token := uuid.New().String()
-	var newUser = User{
-		Name:  name,
-		Pass:  pass,
-		Token: token,
-	}
-	_, err = loginData.InsertOne(ctx, newUser)
+	token, err := newSession(newUser.ID, r)
 	if err != nil {
 		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
 		return
 	}
-	var ans = Answer{
+	ans = Answer{
 		Success: true,
 		Res:     TokenResult{token},
 	}
 	w.WriteHeader(201)
-	w.Write(ans.ToJSON())
+	writeAnswer(w, ans)
 }
 
 // AllowSymsHandler handles allowed symbols list
@@ -186,81 +149,64 @@ func GetTokenHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != "POST" {
 		w.WriteHeader(405)
-		w.Write(Answer{false, "Unsupported method", nil}.ToJSON())
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
 		return
-	} else if r.Header.Get("Content-Type") != "application/json" {
-		w.WriteHeader(415)
-		w.Write(Answer{false, "Unsupported Content-Type", nil}.ToJSON())
+	}
+	var req AuthRequest
+	if !readJSON(w, r, &req) {
 		return
 	}
-	body, err := ioutil.ReadAll(r.Body)
+	us, found, err := store.GetUserByName(req.Name)
 	if err != nil {
 		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
 		return
-	}
-	defer r.Body.Close()
-	if len([]rune(strings.TrimSpace(string(body)))) == 0 {
+	} else if !found {
 		w.WriteHeader(400)
-		w.Write(Answer{false, "Got no data", nil}.ToJSON())
+		writeAnswer(w, Answer{false, codeUserNotFound, "Found no user with this nickname", nil})
 		return
-
 	}
-	var req map[string]interface{}
-	if err := json.Unmarshal(body, &req); err != nil {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Invalid JSON data", nil}.ToJSON())
+	if left := lockedOut(us.ID); left > 0 {
+		tooManyRequests(w, left, Answer{false, codeLockedOut, "Too many wrong passwords; try later", nil})
 		return
 	}
-	var name, pass string
-	if nel, ok := req["name"]; !ok {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Got no name", nil}.ToJSON())
-		return
-	} else if name, ok = nel.(string); !ok {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Got not-string name", nil}.ToJSON())
-		return
-	}
-	if pel, ok := req["pass"]; !ok {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Got no pass", nil}.ToJSON())
+	ok, rehash, err := checkPass(us, req.Pass)
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
 		return
-	} else if pass, ok = pel.(string); !ok {
+	} else if !ok {
+		passFailed(us.ID)
 		w.WriteHeader(400)
-		w.Write(Answer{false, "Got not-string pass", nil}.ToJSON())
+		writeAnswer(w, Answer{false, codeWrongPassword, "Wrong password", nil})
 		return
 	}
-	if name == "admin" && pass == "admin" {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "no admin-admin allowed here)))", nil}.ToJSON())
+	passSucceeded(us.ID)
+	// it's told only to ones who know password
+	if us.Disabled {
+		w.WriteHeader(403)
+		writeAnswer(w, Answer{false, codeAccountDisabled, "Account is disabled", nil})
 		return
 	}
-	if c, err := loginData.CountDocuments(ctx, bson.M{"name": name}); err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-		return
-	} else if c == 0 {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Found no user with this nickname", nil}.ToJSON())
-		return
+	if rehash {
+		// it isn't critical, so errors are only logged
+		if hash, err := hashPass(req.Pass); err != nil {
+			reqLog(r).Error("server-side error", "err", err)
+		} else if err := store.SetUserHash(us.ID, hash); err != nil {
+			reqLog(r).Error("server-side error", "err", err)
+		}
 	}
-	var us User
-	if err := loginData.FindOne(ctx, bson.M{"name": name}).Decode(&us); err != nil {
+	token, err := newSession(us.ID, r)
+	if err != nil {
 		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-		return
-	}
-	if us.Pass != pass {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Wrong password", nil}.ToJSON())
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
 		return
 	}
 	w.WriteHeader(200)
-	w.Write(Answer{true, "", TokenResult{us.Token}}.ToJSON())
+	writeAnswer(w, Answer{true, "", "", TokenResult{token}})
 }
 
 // SendMessageHandler handles message sending
@@ -268,111 +214,67 @@ func SendMessageHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != "POST" {
 		w.WriteHeader(405)
-		w.Write(Answer{false, "Unsupported method", nil}.ToJSON())
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
 		return
-	} else if r.Header.Get("Content-Type") != "application/json" {
+	} else if !isV1(r) && r.Header.Get("Content-Type") != "application/json" {
+		// old clients got 405 here
 		w.WriteHeader(405)
-		w.Write(Answer{false, "Unsupported Content-Type", nil}.ToJSON())
+		writeAnswer(w, Answer{false, codeUnsupportedType, "Unsupported Content-Type", nil})
 		return
 	}
-	token := strings.TrimSpace(r.Header.Get("Auth-Token"))
-	if token == "" {
-		w.WriteHeader(401)
-		w.Write(Answer{false, "Got no Auth-Token", nil}.ToJSON())
-		return
-	} else if !isValidUUID(token) {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Auth-Token is not valid", nil}.ToJSON())
-		return
-	} else if is, err := isInUsers(token); err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-		return
-	} else if !is {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "User with this token not found", nil}.ToJSON())
+	sess, ok := authorize(w, r)
+	if !ok {
 		return
 	}
-	var from User
-	err := loginData.FindOne(ctx, bson.M{"_id": token}).Decode(&from)
-	if err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
+	var req SendMessageRequest
+	if !readJSON(w, r, &req) {
 		return
 	}
-	data, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-		return
-	} else if len(strings.TrimSpace(string(data))) == 0 {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Got no data", nil}.ToJSON())
+	code, ans := sendMessage(reqLog(r), sess.UserID, req)
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
+}
+
+// AckHandler handles delivery and read receipts
+func AckHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
 		return
 	}
-	var req SendMessageRequest
-	err = json.Unmarshal(data, &req)
-	if err != nil {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Invalid JSON", nil}.ToJSON())
+	sess, ok := authorize(w, r)
+	if !ok {
 		return
 	}
-	if strings.TrimSpace(req.PeerName) == "" {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Empty peer_name", nil}.ToJSON())
-		return
-	} else if strings.TrimSpace(req.Message) == "" {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Empty message", nil}.ToJSON())
-		return
-	} else if len([]rune(req.Message)) > 1024 {
-		w.WriteHeader(413)
-		w.Write(Answer{false, "Too long Message", nil}.ToJSON())
+	var req AckRequest
+	if !readJSON(w, r, &req) {
 		return
 	}
-	if rCount, err := loginData.CountDocuments(ctx,
-		bson.M{"name": req.PeerName}); err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-		return
-	} else if rCount == 0 {
-		w.WriteHeader(404)
-		w.Write(Answer{false, "User with this name not found", nil}.ToJSON())
+	code, ans := ack(reqLog(r), sess.UserID, req)
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
+}
+
+// TypingHandler sends typing state to peer or group
+func TypingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
 		return
 	}
-	if c, err := loginData.CountDocuments(ctx, bson.M{"name": req.PeerName}); err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-		return
-	} else if c == 0 {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "User does not exist", nil}.ToJSON())
+	sess, ok := authorize(w, r)
+	if !ok {
 		return
 	}
-	var us User
-	if err := loginData.FindOne(ctx, bson.M{"name": req.PeerName}).Decode(&us); err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
+	var req TypingRequest
+	if !readJSON(w, r, &req) {
 		return
 	}
-	// don't send messages if user sent it
-	if us.Token != token {
-		c, ok := conns[us.Token]
-		if !ok {
-			w.WriteHeader(410)
-			w.Write(Answer{false, "User is offline", nil}.ToJSON())
-			return
-		}
-		c.Conn.Write(Message{from.Name, req.Message, "", ""}.ToJSON())
-	}
-	w.WriteHeader(200)
-	w.Write(Answer{true, "", nil}.ToJSON())
+	code, ans := typing(reqLog(r), sess.UserID, req)
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
 }
 
 // GoOfflineHandler handles going offline
@@ -380,28 +282,23 @@ func GoOfflineHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != "POST" {
 		w.WriteHeader(405)
-		w.Write(Answer{false, "Unsupported method", nil}.ToJSON())
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
 		return
 	}
-	token := strings.TrimSpace(r.Header.Get("Auth-Token"))
-	if len(token) == 0 {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Got no Auth-Token", nil}.ToJSON())
+	sess, ok := authorize(w, r)
+	if !ok {
 		return
 	}
-	var (
-		conn cConn
-		ok   bool
-	)
-	if conn, ok = conns[token]; !ok {
+	conn, ok := conns.Get(sess.UserID)
+	if !ok {
 		w.WriteHeader(404)
-		w.Write(Answer{false, "Connection with this token not found", nil}.ToJSON())
+		writeAnswer(w, Answer{false, codeNotConnected, "Connection with this token not found", nil})
 		return
 	}
-	conn.Conn.Close()
-	delete(conns, token)
+	conns.Remove(sess.UserID, conn)
+	conn.Close()
 	w.WriteHeader(200)
-	w.Write(Answer{true, "", nil}.ToJSON())
+	writeAnswer(w, Answer{true, "", "", nil})
 }
 
 // IsOnlineHandler returns is user by nick online
@@ -409,58 +306,22 @@ func IsOnlineHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method != "POST" {
 		w.WriteHeader(405)
-		w.Write(Answer{false, "Unsupported method", nil}.ToJSON())
-		return
-	}
-	dat, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-		return
-	}
-	defer r.Body.Close()
-	var req map[string]interface{}
-	if err := json.Unmarshal(dat, &req); err != nil {
-		w.WriteHeader(400)
-		w.Write(Answer{false, "Invalid JSON data", nil}.ToJSON())
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
 		return
 	}
-	var (
-		elem interface{}
-		ok   bool
-	)
-	if elem, ok = req["name"]; !ok {
-		w.WriteHeader(400)
-		w.Write(Answer{false, `Got no "name" field`, nil}.ToJSON())
+	// presence is hidden from users blocked by
+	// its owner, so anonymous requests aren't allowed
+	sess, ok := authorize(w, r)
+	if !ok {
 		return
 	}
-	var name string
-	if name, ok = elem.(string); !ok {
-		w.WriteHeader(400)
-		w.Write(Answer{false, `"name" field is not string type`, nil}.ToJSON())
+	var req IsOnlineRequest
+	if !readJSON(w, r, &req) {
 		return
 	}
-	var (
-		us User
-		c  int64
-	)
-	if c, err = loginData.CountDocuments(ctx, bson.M{"name": name}); err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-		return
-	} else if c != 0 {
-		if err := loginData.FindOne(ctx, bson.M{"name": name}).Decode(&us); err != nil {
-			w.WriteHeader(500)
-			errl.Println(err)
-			w.Write(Answer{false, "Server-side error", nil}.ToJSON())
-			return
-		}
-	}
-	_, cOk := conns[us.Token]
-	w.WriteHeader(200)
-	w.Write(Answer{true, "", IsOnlineResult{cOk, c != 0}}.ToJSON())
+	code, ans := isOnline(reqLog(r), sess.UserID, req.Name)
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
 }
 
 // HeartbeatHandler implements hearbeat
@@ -470,25 +331,25 @@ func HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprint(w, "Unsupported method")
 		return
 	}
-	dat, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		w.WriteHeader(500)
-		errl.Println(err)
-		w.Write(Answer{false, "Server-side error", nil}.ToJSON())
+	dat, ok := readBody(w, r)
+	if !ok {
 		return
 	}
-	defer r.Body.Close()
 	tok := strings.TrimSpace(string(dat))
-	var c net.Conn
-	if cc, ok := conns[tok]; !ok {
+	sess, ok, err := checkSession(tok)
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		fmt.Fprint(w, "Server-side error")
+		return
+	} else if !ok {
 		w.WriteHeader(400)
 		fmt.Fprint(w, "Found no users online with this token")
 		return
-	} else if true { // sorry, but i hate arguing linter
-		c = cc.Conn
 	}
-	conns[tok] = cConn{
-		Conn: c,
-		last: time.Now(),
+	if !conns.Beat(sess.UserID) {
+		w.WriteHeader(400)
+		fmt.Fprint(w, "Found no users online with this token")
+		return
 	}
 }
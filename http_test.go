@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testServer returns router with empty
+// in-memory store and fast passwords
+func testServer() http.Handler {
+	store = newMemStore()
+	conf.RateLimit.Disabled = true
+	conf.Pass.Algo = algoArgon2id
+	conf.Pass.Argon2.Time, conf.Pass.Argon2.Memory, conf.Pass.Argon2.Threads = 1, 64, 1
+	conf.Sessions.TTL = 60
+	conf.Queue.TTL, conf.Queue.Max = 60, 100
+	return mw(newRouter())
+}
+
+// apiAnswer is answer of both versions of API
+type apiAnswer struct {
+	Success bool                   `json:"success"`
+	Succes  bool                   `json:"succes"`
+	Code    string                 `json:"code"`
+	Error   string                 `json:"error"`
+	Res     map[string]interface{} `json:"result"`
+}
+
+// call sends request with JSON body and
+// token, if it isn't empty, to h
+func call(t *testing.T, h http.Handler, method, path, token, body string) (int, apiAnswer) {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Auth-Token", token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	var ans apiAnswer
+	if err := json.Unmarshal(rec.Body.Bytes(), &ans); err != nil {
+		t.Fatalf("%s %s: %v in %q", method, path, err, rec.Body.String())
+	}
+	return rec.Code, ans
+}
+
+func TestMessageFlow(t *testing.T) {
+	h := testServer()
+	for _, name := range []string{"alice", "bobby"} {
+		if code, ans := call(t, h, "POST", "/reg", "", `{"name":"`+name+`","pass":"pass"}`); code != 201 || !ans.Succes {
+			t.Fatalf("/reg %s = %d %+v", name, code, ans)
+		}
+	}
+	code, ans := call(t, h, "POST", "/get_token", "", `{"name":"alice","pass":"pass"}`)
+	if code != 200 || !ans.Succes {
+		t.Fatalf("/get_token = %d %+v", code, ans)
+	}
+	token, _ := ans.Res["token"].(string)
+	// bobby isn't connected, so message is queued
+	code, ans = call(t, h, "POST", "/send_message", token, `{"peer_name":"bobby","message":"hello"}`)
+	if code != 202 || ans.Res["status"] != "queued" {
+		t.Fatalf("/send_message = %d %+v", code, ans)
+	}
+	code, ans = call(t, h, "GET", "/v1/history?peer=bobby", token, "")
+	if code != 200 || !ans.Success {
+		t.Fatalf("/v1/history = %d %+v", code, ans)
+	}
+	msgs, _ := ans.Res["messages"].([]interface{})
+	if len(msgs) != 1 || msgs[0].(map[string]interface{})["message"] != "hello" {
+		t.Fatalf("history = %v, want one hello", msgs)
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	h := testServer()
+	code, ans := call(t, h, "POST", "/v1/reg", "", `{"name":"alice","pass":"pass"}`)
+	if code != 201 {
+		t.Fatalf("/v1/reg = %d %+v", code, ans)
+	}
+	token, _ := ans.Res["token"].(string)
+	tests := []struct {
+		path, token, body string
+		code              int
+		errCode           string
+	}{
+		{"/v1/reg", "", `{"name":"alice","pass":"other"}`, 400, codeNameTaken},
+		{"/v1/get_token", "", `{"name":"alice","pass":"wrong"}`, 400, codeWrongPassword},
+		{"/v1/get_token", "", `{"name":"nobody","pass":"pass"}`, 400, codeUserNotFound},
+		{"/v1/send_message", "", `{"peer_name":"alice","message":"hi"}`, 401, codeMissingToken},
+		{"/v1/send_message", "bad", `{"peer_name":"alice","message":"hi"}`, 400, codeInvalidToken},
+		{"/v1/send_message", token, `{"peer_name":"nobody","message":"hi"}`, 404, codeUserNotFound},
+		{"/v1/go_offline", token, `{}`, 404, codeNotConnected},
+	}
+	for _, tt := range tests {
+		code, ans := call(t, h, "POST", tt.path, tt.token, tt.body)
+		if code != tt.code || ans.Code != tt.errCode {
+			t.Errorf("%s %s = %d %s, want %d %s", tt.path, tt.body, code, ans.Code, tt.code, tt.errCode)
+		}
+	}
+}
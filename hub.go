@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// hub is registry of online users' connections.
+// It's safe for concurrent use
+type hub struct {
+	mu    sync.RWMutex
+	conns map[string]*cConn
+}
+
+func newHub() *hub {
+	return &hub{conns: make(map[string]*cConn)}
+}
+
+// Add registers connection of user;
+// it returns false if user already has one
+func (h *hub) Add(userID string, c *cConn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.conns[userID]; ok {
+		return false
+	}
+	h.conns[userID] = c
+	return true
+}
+
+// Get returns user's connection
+func (h *hub) Get(userID string) (*cConn, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	c, ok := h.conns[userID]
+	return c, ok
+}
+
+// Remove unregisters user's connection if it's c,
+// so old connection can't remove new one
+func (h *hub) Remove(userID string, c *cConn) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if cur, ok := h.conns[userID]; !ok || cur != c {
+		return false
+	}
+	delete(h.conns, userID)
+	return true
+}
+
+// Beat updates time of user's last heartbeat;
+// it returns false if user is offline
+func (h *hub) Beat(userID string) bool {
+	c, ok := h.Get(userID)
+	if ok {
+		c.Beat()
+	}
+	return ok
+}
+
+// Reap closes and removes connections
+// with last heartbeat before t
+func (h *hub) Reap(t time.Time) (n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for userID, c := range h.conns {
+		if c.Last().Before(t) {
+			delete(h.conns, userID)
+			c.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// All returns all registered connections
+func (h *hub) All() []*cConn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var list = make([]*cConn, 0, len(h.conns))
+	for _, c := range h.conns {
+		list = append(list, c)
+	}
+	return list
+}
+
+// Len returns count of registered connections
+func (h *hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.conns)
+}
+
+// writeTimeout is time given to every write to
+// connection; client which doesn't read is
+// dropped after it, so writers don't hang
+const writeTimeout = 10 * time.Second
+
+// writeDeadliner is connection which can time out
+// writes; net.Conn and WebSocket connection are
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// cConn is user's connection; Conn
+// is TCP or WebSocket connection
+type cConn struct {
+	Conn io.WriteCloser
+	// id of session connection
+	// was opened with
+	session string
+
+	// wmu serializes writes, so concurrent
+	// messages don't interleave
+	wmu     sync.Mutex
+	timeout time.Duration
+	mu      sync.Mutex
+	last    time.Time
+}
+
+func newCConn(conn io.WriteCloser, session string) *cConn {
+	return &cConn{
+		Conn:    conn,
+		session: session,
+		timeout: writeTimeout,
+		last:    time.Now(),
+	}
+}
+
+// Write writes whole b to connection without
+// interleaving with other writes. Connection is
+// closed if write fails or times out (see writeTimeout)
+func (c *cConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.write(b)
+}
+
+// write is Write for caller holding wmu
+func (c *cConn) write(b []byte) (int, error) {
+	if d, ok := c.Conn.(writeDeadliner); ok {
+		d.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		// reader of connection fails then
+		// and removes it from hub
+		c.Conn.Close()
+	}
+	return n, err
+}
+
+// lockedConn writes to cConn whose wmu is held by caller
+type lockedConn struct {
+	*cConn
+}
+
+func (c lockedConn) Write(b []byte) (int, error) {
+	return c.write(b)
+}
+
+// Close closes connection
+func (c *cConn) Close() error {
+	return c.Conn.Close()
+}
+
+// Beat sets time of last heartbeat to now
+func (c *cConn) Beat() {
+	c.mu.Lock()
+	c.last = time.Now()
+	c.mu.Unlock()
+}
+
+// Last returns time of last heartbeat
+func (c *cConn) Last() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
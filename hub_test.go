@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowConn writes byte by byte, so unsynchronized
+// writes would interleave
+type slowConn struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	for _, x := range b {
+		c.mu.Lock()
+		c.buf.WriteByte(x)
+		c.mu.Unlock()
+		runtime.Gosched()
+	}
+	return len(b), nil
+}
+
+func (c *slowConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *slowConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func TestHubConcurrent(t *testing.T) {
+	h := newHub()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprint("user", i%10)
+			c := newCConn(&slowConn{}, "s")
+			for j := 0; j < 100; j++ {
+				if h.Add(id, c) {
+					h.Beat(id)
+					if got, ok := h.Get(id); ok && got == c {
+						h.Remove(id, c)
+					}
+				}
+				h.Get(id)
+				h.Len()
+				h.All()
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			h.Reap(time.Now().Add(-time.Hour))
+		}
+	}()
+	wg.Wait()
+}
+
+func TestHubAddRemove(t *testing.T) {
+	h := newHub()
+	a, b := newCConn(&slowConn{}, "a"), newCConn(&slowConn{}, "b")
+	if !h.Add("u", a) {
+		t.Fatal("first Add failed")
+	} else if h.Add("u", b) {
+		t.Fatal("second Add of same user succeeded")
+	}
+	if h.Remove("u", b) {
+		t.Fatal("Remove of other connection succeeded")
+	} else if c, ok := h.Get("u"); !ok || c != a {
+		t.Fatal("connection was removed by other one")
+	}
+	if !h.Remove("u", a) {
+		t.Fatal("Remove failed")
+	} else if _, ok := h.Get("u"); ok || h.Beat("u") {
+		t.Fatal("user is online after Remove")
+	}
+}
+
+func TestHubReap(t *testing.T) {
+	h := newHub()
+	oldConn, newConn := &slowConn{}, &slowConn{}
+	old, fresh := newCConn(oldConn, "a"), newCConn(newConn, "b")
+	old.last = time.Now().Add(-time.Minute)
+	h.Add("old", old)
+	h.Add("fresh", fresh)
+	if n := h.Reap(time.Now().Add(-time.Second)); n != 1 {
+		t.Fatalf("Reap = %d, want 1", n)
+	}
+	if _, ok := h.Get("old"); ok || !oldConn.isClosed() {
+		t.Fatal("stale connection isn't reaped")
+	} else if _, ok := h.Get("fresh"); !ok || newConn.isClosed() {
+		t.Fatal("fresh connection is reaped")
+	}
+}
+
+func TestConnWriteNoInterleave(t *testing.T) {
+	sc := &slowConn{}
+	c := newCConn(sc, "s")
+	msgs := [][]byte{
+		bytes.Repeat([]byte("a"), 64),
+		bytes.Repeat([]byte("b"), 64),
+	}
+	const n = 50
+	var wg sync.WaitGroup
+	for _, m := range msgs {
+		wg.Add(1)
+		go func(m []byte) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				c.Write(m)
+			}
+		}(m)
+	}
+	wg.Wait()
+	out := sc.buf.Bytes()
+	if len(out) != 2*n*64 {
+		t.Fatalf("wrote %d bytes, want %d", len(out), 2*n*64)
+	}
+	for i := 0; i < len(out); i += 64 {
+		if !bytes.Equal(out[i:i+64], msgs[0]) && !bytes.Equal(out[i:i+64], msgs[1]) {
+			t.Fatalf("writes interleaved at %d: %q", i, out[i:i+64])
+		}
+	}
+}
+
+// stuckConn is client which never reads: its
+// writes block until write deadline
+type stuckConn struct {
+	slowConn
+	deadline time.Time
+}
+
+func (c *stuckConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *stuckConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Until(c.deadline))
+	return 0, timeoutError{}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestConnWriteTimeout(t *testing.T) {
+	sc := &stuckConn{}
+	c := newCConn(sc, "s")
+	c.timeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err := c.Write([]byte("msg\n")); err == nil {
+		t.Fatal("write to stuck connection succeeded")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("write took %v", d)
+	} else if !sc.isClosed() {
+		t.Fatal("stuck connection isn't closed")
+	}
+}
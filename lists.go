@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+)
+
+// maxListLen is max count of users in
+// one list (subscriptions, contacts etc.)
+// of one user
+const maxListLen = 1000
+
+// changeList adds user with name to list of user
+// with userID or removes them if add is false
+func changeList(l *logger, list, userID string, req ListRequest, add bool) (User, int, Answer) {
+	us, found, err := store.GetUserByName(req.Name)
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return User{}, 500, Answer{false, codeInternal, "Server-side error", nil}
+	} else if !found {
+		return User{}, 404, Answer{false, codeUserNotFound, "User with this name not found", nil}
+	} else if us.ID == userID {
+		return User{}, 400, Answer{false, codeSelfAction, "Can't add yourself", nil}
+	}
+	if !add {
+		if err := store.RemoveFromList(list, userID, us.ID); err != nil {
+			l.Error("server-side error", "err", err)
+			return User{}, 500, Answer{false, codeInternal, "Server-side error", nil}
+		}
+		return us, 200, Answer{true, "", "", nil}
+	}
+	if ok, err := store.AddToList(list, userID, us.ID, maxListLen); err != nil {
+		l.Error("server-side error", "err", err)
+		return User{}, 500, Answer{false, codeInternal, "Server-side error", nil}
+	} else if !ok {
+		return User{}, 413, Answer{false, codeListFull, "Too many users in " + list, nil}
+	}
+	return us, 200, Answer{true, "", "", nil}
+}
+
+// listUsers returns users in list of user with userID
+func listUsers(list, userID string) ([]User, error) {
+	ids, err := store.List(list, userID)
+	if err != nil {
+		return nil, err
+	}
+	var users = make([]User, 0, len(ids))
+	for _, id := range ids {
+		us, found, err := store.GetUserByID(id)
+		if err != nil {
+			return nil, err
+		} else if found {
+			users = append(users, us)
+		}
+	}
+	return users, nil
+}
+
+// isBlocked tells if user with userID
+// is blocked by user with byID
+func isBlocked(userID, byID string) (bool, error) {
+	return store.InList(listBlocked, byID, userID)
+}
+
+// blockers returns set of users who
+// blocked user with userID
+func blockers(userID string) (map[string]bool, error) {
+	ids, err := store.ListedBy(listBlocked, userID)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set, nil
+}
+
+// AddContactHandler adds user to contacts
+func AddContactHandler(w http.ResponseWriter, r *http.Request) {
+	changeListHandler(w, r, listContacts, true)
+}
+
+// RemoveContactHandler removes user from contacts
+func RemoveContactHandler(w http.ResponseWriter, r *http.Request) {
+	changeListHandler(w, r, listContacts, false)
+}
+
+// BlockHandler blocks user: their messages are
+// rejected and they don't see presence
+func BlockHandler(w http.ResponseWriter, r *http.Request) {
+	changeListHandler(w, r, listBlocked, true)
+}
+
+// UnblockHandler unblocks user
+func UnblockHandler(w http.ResponseWriter, r *http.Request) {
+	changeListHandler(w, r, listBlocked, false)
+}
+
+func changeListHandler(w http.ResponseWriter, r *http.Request, list string, add bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	var req ListRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	_, code, ans := changeList(reqLog(r), list, sess.UserID, req, add)
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
+}
+
+// ContactsHandler returns names of user's contacts
+func ContactsHandler(w http.ResponseWriter, r *http.Request) {
+	listHandler(w, r, listContacts)
+}
+
+// BlockedHandler returns names of users blocked by user
+func BlockedHandler(w http.ResponseWriter, r *http.Request) {
+	listHandler(w, r, listBlocked)
+}
+
+func listHandler(w http.ResponseWriter, r *http.Request, list string) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	users, err := listUsers(list, sess.UserID)
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	var names = make([]string, len(users))
+	for i, us := range users {
+		names[i] = us.Name
+	}
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", UsersResult{names}})
+}
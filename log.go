@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log levels
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// log formats
+const (
+	formatLogfmt = "logfmt"
+	formatJSON   = "json"
+)
+
+// logOutput is shared by logger and
+// all loggers made by its With
+type logOutput struct {
+	mu     sync.Mutex
+	out    io.Writer
+	err    io.Writer
+	level  int
+	format string
+}
+
+// logger writes structured lines: time, level, msg,
+// caller and key, value pairs. Warnings and errors
+// are written to stderr, other ones to stdout
+type logger struct {
+	o      *logOutput
+	fields []interface{}
+}
+
+// lg is main logger; handlers should use reqLog
+// and TCP sessions own one with conn_id
+var lg = &logger{o: &logOutput{
+	out:    os.Stdout,
+	err:    os.Stderr,
+	level:  levelInfo,
+	format: formatLogfmt,
+}}
+
+// configure sets level and format by their names
+func (l *logger) configure(level, format string) error {
+	var lvl = -1
+	for i, name := range levelNames {
+		if name == level {
+			lvl = i
+		}
+	}
+	if lvl == -1 {
+		return fmt.Errorf("unknown log.level %q (should be one of %s)",
+			level, strings.Join(levelNames, ", "))
+	}
+	if format != formatLogfmt && format != formatJSON {
+		return fmt.Errorf("unknown log.format %q (should be %q or %q)",
+			format, formatLogfmt, formatJSON)
+	}
+	l.o.mu.Lock()
+	l.o.level, l.o.format = lvl, format
+	l.o.mu.Unlock()
+	return nil
+}
+
+// With returns logger which adds key, value
+// pairs kv to every line
+func (l *logger) With(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &logger{o: l.o, fields: fields}
+}
+
+func (l *logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(levelInfo, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(levelWarn, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+func (l *logger) log(level int, msg string, kv []interface{}) {
+	l.o.mu.Lock()
+	defer l.o.mu.Unlock()
+	if level < l.o.level {
+		return
+	}
+	caller := "???"
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	var all = []interface{}{
+		"time", time.Now().Format(time.RFC3339Nano),
+		"level", levelNames[level],
+		"msg", msg,
+		"caller", caller,
+	}
+	all = append(append(all, l.fields...), kv...)
+	var b strings.Builder
+	if l.o.format == formatJSON {
+		b.WriteByte('{')
+	}
+	for i := 0; i < len(all); i += 2 {
+		key, val := fmt.Sprint(all[i]), "!MISSING"
+		if i+1 < len(all) {
+			val = logValue(all[i+1])
+		}
+		if l.o.format == formatJSON {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Quote(key) + ":" + strconv.Quote(val))
+			continue
+		}
+		if i != 0 {
+			b.WriteByte(' ')
+		}
+		if strings.ContainsAny(val, " =\"\t\n") || val == "" {
+			val = strconv.Quote(val)
+		}
+		b.WriteString(key + "=" + val)
+	}
+	if l.o.format == formatJSON {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+	out := l.o.out
+	if level >= levelWarn {
+		out = l.o.err
+	}
+	io.WriteString(out, b.String())
+}
+
+func logValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "<nil>"
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type logKey struct{}
+
+// reqLog returns logger of request made by mw
+func reqLog(r *http.Request) *logger {
+	if l, ok := r.Context().Value(logKey{}).(*logger); ok {
+		return l
+	}
+	return lg
+}
+
+// newCorrelationID returns random id for
+// request or TCP session
+func newCorrelationID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestID returns id from X-Request-ID header
+// of request, so proxies can set own ones, or
+// new id if it's empty or looks wrong
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 64 {
+		return newCorrelationID()
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(allowedSymbols, c) {
+			return newCorrelationID()
+		}
+	}
+	return id
+}
+
+// withRequestLog sets X-Request-ID header and
+// puts logger with request_id to request
+func withRequestLog(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := requestID(r)
+	w.Header().Set("X-Request-ID", id)
+	l := lg.With("request_id", id)
+	return r.WithContext(context.WithValue(r.Context(), logKey{}, l))
+}
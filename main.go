@@ -7,61 +7,122 @@ import (
 	"github.com/caarlos0/env"
 	"github.com/gorilla/mux"
 	jsoniter "github.com/json-iterator/go"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 )
 
 var (
-	infl, errl, debl *log.Logger
-	conf             = struct {
+	conf = struct {
+		Store struct {
+			Type string `toml:"type" env:"STORETYPE"`
+		} `toml:"store"`
 		Mongo struct {
 			URL string `toml:"url" env:"MONGOURL,notEmpty"`
 		} `toml:"mongo"`
 		HTTP struct {
-			Port uint16 `toml:"port" env:"HTTPPORT"`
+			Port uint16  `toml:"port" env:"HTTPPORT"`
+			TLS  tlsConf `toml:"tls"`
 		} `toml:"http"`
 		TCP struct {
 			Port uint16 `toml:"port" env:"TCPPORT"`
+			// HeartbeatTimeout is time in seconds after last
+			// heartbeat when connection is closed
+			HeartbeatTimeout uint    `toml:"heartbeat_timeout" env:"HEARTBEATTIMEOUT"`
+			TLS              tlsConf `toml:"tls"`
 		} `toml:"tcp"`
+		Sessions struct {
+			// TTL is lifetime of session in seconds
+			TTL uint `toml:"ttl" env:"SESSIONTTL"`
+		} `toml:"sessions"`
+		Queue struct {
+			// TTL is lifetime of queued message in seconds
+			TTL uint `toml:"ttl" env:"QUEUETTL"`
+			// Max is max count of queued messages per user
+			Max int `toml:"max" env:"QUEUEMAX"`
+		} `toml:"queue"`
+		Pass struct {
+			Algo       string `toml:"algo" env:"PASSALGO"`
+			BcryptCost int    `toml:"bcrypt_cost" env:"BCRYPTCOST"`
+			Argon2     struct {
+				Time    uint `toml:"time" env:"ARGON2TIME"`
+				Memory  uint `toml:"memory" env:"ARGON2MEMORY"`
+				Threads uint `toml:"threads" env:"ARGON2THREADS"`
+			} `toml:"argon2"`
+		} `toml:"pass"`
+		RateLimit rateLimitConf `toml:"ratelimit"`
+		Admin     struct {
+			// Users are names of users who are admins
+			// regardless of role, so first admin can
+			// be set up
+			Users []string `toml:"users" env:"ADMINUSERS"`
+		} `toml:"admin"`
+		Shutdown struct {
+			// Timeout is time in seconds given to
+			// connections to finish on shutdown
+			Timeout uint `toml:"timeout" env:"SHUTDOWNTIMEOUT"`
+		} `toml:"shutdown"`
+		Log struct {
+			// Level is debug, info, warn or error
+			Level string `toml:"level" env:"LOGLEVEL"`
+			// Format is logfmt or json
+			Format string `toml:"format" env:"LOGFORMAT"`
+		} `toml:"log"`
 	}{}
 
-	mongoClient *mongo.Client
-	appDB       *mongo.Database
-	loginData   *mongo.Collection
-	json             = jsoniter.ConfigCompatibleWithStandardLibrary
-	ctx              = context.Background()
-	conns            = make(map[string]cConn)
-	initFailed  bool = true
+	store     Store
+	httpCerts *certReloader
+	tcpCerts  *certReloader
+	json      = jsoniter.ConfigCompatibleWithStandardLibrary
+	ctx       = context.Background()
+	conns     = newHub()
 )
 
-func init() {
-	fmt.Print("Open loggers: ... ")
-	infl = log.New(os.Stdout, "[INFO]\t", log.Ldate|log.Ltime|log.Lshortfile)
-	errl = log.New(os.Stderr, "[ERROR]\t", log.Ldate|log.Ltime|log.LstdFlags|log.Lshortfile)
-	debl = log.New(os.Stderr, "[DEBUG]\t", log.Ldate|log.Ltime|log.LstdFlags|log.Lshortfile)
-	fmt.Println("\rOpen loggers: success")
+// loadConfig reads config and checks it;
+// errors are logged
+func loadConfig() bool {
 	fmt.Print("Read conf: ...")
 	if tomlData, err := ioutil.ReadFile("config.toml"); err == nil {
 		if err := toml.Unmarshal(tomlData, &conf); err != nil {
-			errl.Println(err)
-			return
+			lg.Error("parsing config.toml", "err", err)
+			return false
 		}
 	} else if !os.IsNotExist(err) {
-		errl.Println(err)
-		return
+		lg.Error("reading config.toml", "err", err)
+		return false
 	} else if err := env.Parse(&conf); err != nil {
-		errl.Println(err)
-		return
+		lg.Error("parsing environment", "err", err)
+		return false
 	}
 	fmt.Println("\rRead conf: success!")
-	if conf.Mongo.URL == "" {
-		errl.Println("mongo.url is empty")
-		return
+	if conf.Log.Level == "" {
+		conf.Log.Level = "info"
+	}
+	if conf.Log.Format == "" {
+		conf.Log.Format = formatLogfmt
+	}
+	if err := lg.configure(conf.Log.Level, conf.Log.Format); err != nil {
+		lg.Error(err.Error())
+		return false
+	}
+	switch conf.Store.Type {
+	case "":
+		conf.Store.Type = storeMongo
+		fallthrough
+	case storeMongo:
+		if conf.Mongo.URL == "" {
+			lg.Error("mongo.url is empty")
+			return false
+		}
+	case storeMemory:
+	default:
+		lg.Error(fmt.Sprintf("unknown store.type %q (should be %q or %q)",
+			conf.Store.Type, storeMongo, storeMemory))
+		return false
 	}
 	if conf.HTTP.Port == 0 {
 		conf.HTTP.Port = 4422
@@ -69,74 +130,262 @@ func init() {
 	if conf.TCP.Port == 0 {
 		conf.TCP.Port = 4242
 	}
+	if conf.TCP.HeartbeatTimeout == 0 {
+		conf.TCP.HeartbeatTimeout = 120
+	}
 	if conf.HTTP.Port == conf.TCP.Port {
-		infl.Println("[ERROR] http.port equals tcp.port \n" +
+		lg.Error("http.port equals tcp.port " +
 			"(cannot use the same port for both connections)")
-		return
+		return false
+	}
+	if err := checkTLSConf(&conf.HTTP.TLS, "http.tls", 4423); err != nil {
+		lg.Error(err.Error())
+		return false
+	}
+	if err := checkTLSConf(&conf.TCP.TLS, "tcp.tls", 4243); err != nil {
+		lg.Error(err.Error())
+		return false
+	}
+	var ports = map[uint16]string{conf.HTTP.Port: "http.port"}
+	for name, p := range map[string]uint16{
+		"tcp.port":      conf.TCP.Port,
+		"http.tls.port": conf.HTTP.TLS.Port,
+		"tcp.tls.port":  conf.TCP.TLS.Port,
+	} {
+		if p == 0 {
+			continue
+		} else if other, ok := ports[p]; ok {
+			lg.Error(fmt.Sprintf("%s equals %s (cannot use the same port for both connections)", name, other))
+			return false
+		}
+		ports[p] = name
+	}
+	switch conf.Pass.Algo {
+	case "":
+		conf.Pass.Algo = algoArgon2id
+	case algoArgon2id, algoBcrypt:
+	default:
+		lg.Error(fmt.Sprintf("unknown pass.algo %q (should be %q or %q)",
+			conf.Pass.Algo, algoArgon2id, algoBcrypt))
+		return false
+	}
+	if conf.Pass.BcryptCost == 0 {
+		conf.Pass.BcryptCost = bcrypt.DefaultCost
+	} else if conf.Pass.BcryptCost < bcrypt.MinCost || conf.Pass.BcryptCost > bcrypt.MaxCost {
+		lg.Error(fmt.Sprintf("pass.bcrypt_cost should be in [%d; %d]", bcrypt.MinCost, bcrypt.MaxCost))
+		return false
+	}
+	if conf.Pass.Argon2.Time == 0 {
+		conf.Pass.Argon2.Time = 1
+	}
+	if conf.Pass.Argon2.Memory == 0 {
+		conf.Pass.Argon2.Memory = 64 * 1024
 	}
+	if conf.Pass.Argon2.Threads == 0 {
+		conf.Pass.Argon2.Threads = 4
+	} else if conf.Pass.Argon2.Threads > 255 {
+		lg.Error("pass.argon2.threads should be less than 256")
+		return false
+	}
+	if conf.Sessions.TTL == 0 {
+		conf.Sessions.TTL = 30 * 24 * 60 * 60
+	}
+	if conf.Queue.TTL == 0 {
+		conf.Queue.TTL = 7 * 24 * 60 * 60
+	}
+	if conf.Queue.Max == 0 {
+		conf.Queue.Max = 100
+	} else if conf.Queue.Max < 0 {
+		lg.Error("queue.max should be positive")
+		return false
+	}
+	if conf.Shutdown.Timeout == 0 {
+		conf.Shutdown.Timeout = 10
+	}
+	if err := checkRateLimitConf(&conf.RateLimit); err != nil {
+		lg.Error(err.Error())
+		return false
+	}
+	initLimiters(conf.RateLimit)
 	fmt.Println("\rRead conf: success")
-	fmt.Print("Open MongoDB Client: ...")
-	mongoClient, err := mongo.NewClient(options.Client().ApplyURI(conf.Mongo.URL))
-	if err != nil {
-		errl.Println(err)
-		return
-	}
-	fmt.Println("\rOpen MongoDB Client: success")
-	fmt.Print("Connect to MongoDB: ...")
-	err = mongoClient.Connect(ctx)
-	if err != nil {
-		errl.Println(err)
-		return
-	}
-	fmt.Println("\rConnect to MongoDB: success")
-	fmt.Print("Init MongoDB: ...")
-	appDB = mongoClient.Database("app")
-	loginData = appDB.Collection("login")
-	fmt.Println("\rInit MongoDB: success")
-	initFailed = false
+	if conf.HTTP.TLS.Enabled() || conf.TCP.TLS.Enabled() {
+		fmt.Print("Load certificates: ...")
+		var err error
+		if conf.HTTP.TLS.Enabled() {
+			if httpCerts, err = newCertReloader(conf.HTTP.TLS); err != nil {
+				lg.Error("loading http.tls certificate", "err", err)
+				return false
+			}
+		}
+		if conf.TCP.TLS.Enabled() {
+			if tcpCerts, err = newCertReloader(conf.TCP.TLS); err != nil {
+				lg.Error("loading tcp.tls certificate", "err", err)
+				return false
+			}
+		}
+		fmt.Println("\rLoad certificates: success")
+	}
+	return true
+}
+
+// openStore connects to store from config
+func openStore() bool {
+	if conf.Store.Type == storeMemory {
+		lg.Warn("using in-memory store; all data will be lost on exit")
+		store = newMemStore()
+	} else {
+		fmt.Print("Init MongoDB: ...")
+		ms, err := newMongoStore(conf.Mongo.URL)
+		if err != nil {
+			lg.Error("connecting to MongoDB", "err", err)
+			return false
+		}
+		store = ms
+		fmt.Println("\rInit MongoDB: success")
+	}
+	return true
 }
 
 func main() {
-	if initFailed {
-		return
+	if !runCommand(os.Args[1:]) {
+		os.Exit(1)
 	}
-	defer infl.Println("[END]   ========================")
+}
+
+// newRouter returns router with all routes
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
-	router.HandleFunc("/reg", RegHandler)
-	router.HandleFunc("/get_token", GetTokenHandler)
-	router.HandleFunc("/go_offline", GoOfflineHandler)
-	router.HandleFunc("/send_message", SendMessageHandler)
-	router.HandleFunc("/is_online", IsOnlineHandler)
-	router.HandleFunc("/heartbeat", HeartbeatHandler)
-	router.HandleFunc("/allowed_syms", AllowSymsHandler)
+	// API routes are served both with and
+	// without version prefix
+	v1 := router.PathPrefix(apiV1).Subrouter()
+	handle := func(path string, h http.HandlerFunc) {
+		router.HandleFunc(path, h)
+		if path != "/ws" {
+			v1.HandleFunc(path, h)
+		}
+	}
+	handle("/reg", RegHandler)
+	handle("/get_token", GetTokenHandler)
+	handle("/go_offline", GoOfflineHandler)
+	handle("/send_message", SendMessageHandler)
+	handle("/ack", AckHandler)
+	handle("/typing", TypingHandler)
+	handle("/is_online", IsOnlineHandler)
+	handle("/heartbeat", HeartbeatHandler)
+	handle("/allowed_syms", AllowSymsHandler)
+	handle("/history", HistoryHandler)
+	handle("/ws", WSHandler)
+	handle("/groups", GroupsHandler)
+	handle("/create_group", CreateGroupHandler)
+	handle("/group_invite", InviteToGroupHandler)
+	handle("/group_remove", RemoveFromGroupHandler)
+	handle("/leave_group", LeaveGroupHandler)
+	handle("/rename_group", RenameGroupHandler)
+	handle("/group_role", GroupRoleHandler)
+	handle("/subscribe", SubscribeHandler)
+	handle("/unsubscribe", UnsubscribeHandler)
+	handle("/subscriptions", SubscriptionsHandler)
+	handle("/contacts", ContactsHandler)
+	handle("/add_contact", AddContactHandler)
+	handle("/remove_contact", RemoveContactHandler)
+	handle("/blocked", BlockedHandler)
+	handle("/block", BlockHandler)
+	handle("/unblock", UnblockHandler)
+	handle("/sessions", SessionsHandler)
+	handle("/revoke_session", RevokeSessionHandler)
+	handle("/admin/users", AdminUsersHandler)
+	handle("/admin/disable", AdminDisableHandler)
+	handle("/admin/enable", AdminEnableHandler)
+	handle("/admin/delete_user", AdminDeleteUserHandler)
+	handle("/admin/disconnect", AdminDisconnectHandler)
+	handle("/admin/reset_password", AdminResetPasswordHandler)
+	handle("/admin/set_role", AdminSetRoleHandler)
+	handle("/admin/audit", AdminAuditHandler)
+	router.HandleFunc("/metrics", MetricsHandler)
+	router.HandleFunc("/healthz", HealthzHandler)
+	router.HandleFunc("/readyz", ReadyzHandler)
+	router.HandleFunc("/openapi.json", OpenAPIHandler)
 	router.HandleFunc("/", root)
-	infl.Println("[START] ========================")
+	return router
+}
+
+// runServer starts listeners and serves
+// until SIGINT, SIGTERM or listener's fail
+func runServer() bool {
+	if !loadConfig() || !openStore() {
+		return false
+	}
+	defer lg.Info("stopped")
+	router := newRouter()
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if path, err := route.GetPathTemplate(); err == nil {
+			knownRoutes[path] = true
+		}
+		return nil
+	})
+	if err := initOpenAPI(); err != nil {
+		lg.Error("encoding OpenAPI document", "err", err)
+		return false
+	}
+	lg.Info("started", "http_port", conf.HTTP.Port, "tcp_port", conf.TCP.Port)
 	var mainDeathChan = make(chan struct{})
-	go func() {
-		err := listenPort(conf.TCP.Port)
-		if err != nil {
-			errl.Println("listen tcp:", err.Error())
+	serve := func(name string, listen func() error) {
+		go func() {
+			err := listen()
+			// listeners are stopped by shutdown
+			if isShuttingDown() {
+				return
+			}
+			if err != nil {
+				lg.Error("listening", "listener", name, "err", err)
+			}
+			mainDeathChan <- struct{}{}
+		}()
+	}
+	go reaper(time.Duration(conf.TCP.HeartbeatTimeout) * time.Second)
+	if !conf.TCP.TLS.Only {
+		serve("tcp", func() error {
+			return listenPort(conf.TCP.Port, nil)
+		})
+	}
+	if conf.TCP.TLS.Enabled() {
+		serve("tcp tls", func() error {
+			return listenPort(conf.TCP.TLS.Port, tcpCerts.Config())
+		})
+	}
+	var servers []*http.Server
+	if !conf.HTTP.TLS.Only {
+		srv := &http.Server{
+			Addr:    fmt.Sprintf(":%d", conf.HTTP.Port),
+			Handler: mw(router),
 		}
-		mainDeathChan <- struct{}{}
-		return
-	}()
+		servers = append(servers, srv)
+		serve("http", srv.ListenAndServe)
+	}
+	if conf.HTTP.TLS.Enabled() {
+		srv := &http.Server{
+			Addr:      fmt.Sprintf(":%d", conf.HTTP.TLS.Port),
+			Handler:   mw(router),
+			TLSConfig: httpCerts.Config(),
+		}
+		servers = append(servers, srv)
+		serve("http tls", func() error {
+			return srv.ListenAndServeTLS("", "")
+		})
+	}
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 	go func() {
-		err := http.ListenAndServe(fmt.Sprintf(":%d", conf.HTTP.Port),
-			mw(router))
-		if err != nil {
-			errl.Println("listen http:" + err.Error())
-			mainDeathChan <- struct{}{}
-			return
+		for range hupChan {
+			reloadCerts()
 		}
 	}()
 	interruptChan := make(chan os.Signal, 1)
-	signal.Notify(interruptChan, os.Interrupt)
-	for {
-		select {
-		case <-interruptChan:
-			return
-		case <-mainDeathChan:
-			return
-		}
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-interruptChan:
+	case <-mainDeathChan:
 	}
+	shutdown(servers)
+	return true
 }
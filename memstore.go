@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStore keeps everything in memory,
+// so data is lost on restart.
+// It's for development and CI
+type memStore struct {
+	mu       sync.Mutex
+	users    map[string]User
+	sessions map[string]Session
+	// queue is messages to offline
+	// users by recipient id
+	queue map[string][]QueuedMessage
+	// messages is history, oldest first
+	messages []StoredMessage
+	groups   map[string]Group
+	audit    []AuditEntry
+	// lists is per-user lists: list ->
+	// user id -> set of target ids
+	lists map[string]map[string]map[string]bool
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		users:    make(map[string]User),
+		sessions: make(map[string]Session),
+		queue:    make(map[string][]QueuedMessage),
+		groups:   make(map[string]Group),
+		lists:    make(map[string]map[string]map[string]bool),
+	}
+}
+
+func (s *memStore) GetUserByName(name string) (User, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, us := range s.users {
+		if us.Name == name {
+			return us, true, nil
+		}
+	}
+	return User{}, false, nil
+}
+
+func (s *memStore) GetUserByID(id string) (User, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	us, ok := s.users[id]
+	return us, ok, nil
+}
+
+func (s *memStore) ListUsers(query, after string, limit int) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	query = strings.ToLower(query)
+	var list = make([]User, 0)
+	for _, us := range s.users {
+		if us.Name > after && strings.Contains(strings.ToLower(us.Name), query) {
+			list = append(list, us)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+func (s *memStore) CreateUser(us User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[us.ID]; ok {
+		return errors.New("user with this id already exists")
+	}
+	s.users[us.ID] = us
+	return nil
+}
+
+func (s *memStore) SetUserHash(id, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if us, ok := s.users[id]; ok {
+		us.Hash, us.Pass = hash, ""
+		s.users[id] = us
+	}
+	return nil
+}
+
+func (s *memStore) SetUserRole(id, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if us, ok := s.users[id]; ok {
+		us.Role = role
+		s.users[id] = us
+	}
+	return nil
+}
+
+func (s *memStore) SetUserDisabled(id string, disabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if us, ok := s.users[id]; ok {
+		us.Disabled = disabled
+		s.users[id] = us
+	}
+	return nil
+}
+
+func (s *memStore) DeleteUser(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, id)
+	for sid, sess := range s.sessions {
+		if sess.UserID == id {
+			delete(s.sessions, sid)
+		}
+	}
+	delete(s.queue, id)
+	for _, users := range s.lists {
+		delete(users, id)
+		for _, set := range users {
+			delete(set, id)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) DeleteSessions(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.UserID == userID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) AddAudit(e AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+func (s *memStore) AuditLog(before string, limit int) ([]AuditEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list = make([]AuditEntry, 0, limit)
+	for i := len(s.audit) - 1; i >= 0 && len(list) < limit; i-- {
+		if before == "" || s.audit[i].ID < before {
+			list = append(list, s.audit[i])
+		}
+	}
+	return list, nil
+}
+
+func (s *memStore) CreateSession(sess Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[sess.ID]; ok {
+		return errors.New("session with this id already exists")
+	}
+	s.sessions[sess.ID] = sess
+	return nil
+}
+
+func (s *memStore) TouchSession(id string, now time.Time) (Session, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return Session{}, false, nil
+	} else if !sess.Expires.After(now) {
+		delete(s.sessions, id)
+		return Session{}, false, nil
+	}
+	sess.LastUsed = now
+	s.sessions[id] = sess
+	return sess, true, nil
+}
+
+func (s *memStore) ListSessions(userID string, now time.Time) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list = make([]Session, 0)
+	for _, sess := range s.sessions {
+		if sess.UserID == userID && sess.Expires.After(now) {
+			list = append(list, sess)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+func (s *memStore) DeleteSession(id, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; !ok || sess.UserID != userID {
+		return false, nil
+	}
+	delete(s.sessions, id)
+	return true, nil
+}
+
+// dropExpired removes expired messages from user's
+// queue; s.mu should be locked
+func (s *memStore) dropExpired(to string, now time.Time) {
+	var list = s.queue[to][:0]
+	for _, m := range s.queue[to] {
+		if m.Expires.After(now) {
+			list = append(list, m)
+		}
+	}
+	if len(list) == 0 {
+		delete(s.queue, to)
+		return
+	}
+	s.queue[to] = list
+}
+
+func (s *memStore) QueueMessage(m QueuedMessage, max int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropExpired(m.To, m.Created)
+	if len(s.queue[m.To]) >= max {
+		return false, nil
+	}
+	s.queue[m.To] = append(s.queue[m.To], m)
+	return true, nil
+}
+
+func (s *memStore) QueuedMessages(to string, now time.Time) ([]QueuedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropExpired(to, now)
+	return append(make([]QueuedMessage, 0, len(s.queue[to])), s.queue[to]...), nil
+}
+
+func (s *memStore) DeleteQueued(ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var del = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		del[id] = true
+	}
+	for to, msgs := range s.queue {
+		var list = msgs[:0]
+		for _, m := range msgs {
+			if !del[m.ID] {
+				list = append(list, m)
+			}
+		}
+		if len(list) == 0 {
+			delete(s.queue, to)
+		} else {
+			s.queue[to] = list
+		}
+	}
+	return nil
+}
+
+func (s *memStore) SaveMessage(m StoredMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, m)
+	return nil
+}
+
+func (s *memStore) DeleteMessage(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.messages {
+		if m.ID == id {
+			s.messages = append(s.messages[:i], s.messages[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memStore) SetReceipt(to string, ids []string, status string, t time.Time) ([]StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var want = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	var list = make([]StoredMessage, 0)
+	for i := range s.messages {
+		m := &s.messages[i]
+		if !want[m.ID] || m.To != to {
+			continue
+		}
+		if status == "read" && m.Read == nil {
+			list = append(list, *m)
+			m.Read = &t
+		} else if status == "delivered" && m.Delivered == nil {
+			list = append(list, *m)
+		}
+		if m.Delivered == nil {
+			m.Delivered = &t
+		}
+	}
+	return list, nil
+}
+
+func (s *memStore) History(a, b, before string, limit int) ([]StoredMessage, error) {
+	return s.history(func(m StoredMessage) bool {
+		return m.Group == "" &&
+			((m.From == a && m.To == b) || (m.From == b && m.To == a))
+	}, before, limit)
+}
+
+func (s *memStore) GroupHistory(groupID, before string, limit int) ([]StoredMessage, error) {
+	return s.history(func(m StoredMessage) bool {
+		return m.Group == groupID
+	}, before, limit)
+}
+
+func (s *memStore) history(match func(StoredMessage) bool, before string, limit int) ([]StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list = make([]StoredMessage, 0, limit)
+	for i := len(s.messages) - 1; i >= 0 && len(list) < limit; i-- {
+		m := s.messages[i]
+		if before != "" && m.ID >= before {
+			continue
+		}
+		if match(m) {
+			list = append(list, m)
+		}
+	}
+	return list, nil
+}
+
+// copyGroup copies members, so stored
+// group can't be changed outside
+func copyGroup(g Group) Group {
+	g.Members = append([]GroupMember(nil), g.Members...)
+	return g
+}
+
+func (s *memStore) CreateGroup(g Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.groups[g.ID]; ok {
+		return errors.New("group with this id already exists")
+	}
+	s.groups[g.ID] = copyGroup(g)
+	return nil
+}
+
+func (s *memStore) GetGroup(id string) (Group, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.groups[id]
+	return copyGroup(g), ok, nil
+}
+
+func (s *memStore) UpdateGroup(g Group) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.groups[g.ID]; !ok || cur.Version != g.Version {
+		return false, nil
+	}
+	g.Version++
+	s.groups[g.ID] = copyGroup(g)
+	return true, nil
+}
+
+func (s *memStore) DeleteGroup(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.groups, id)
+	return nil
+}
+
+func (s *memStore) GroupsOf(userID string) ([]Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list = make([]Group, 0)
+	for _, g := range s.groups {
+		if g.member(userID) >= 0 {
+			list = append(list, copyGroup(g))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+func (s *memStore) SetLastSeen(userID string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if us, ok := s.users[userID]; ok {
+		us.LastSeen = &t
+		s.users[userID] = us
+	}
+	return nil
+}
+
+func (s *memStore) AddToList(list, userID, targetID string, max int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lists[list] == nil {
+		s.lists[list] = make(map[string]map[string]bool)
+	}
+	set, ok := s.lists[list][userID]
+	if !ok {
+		set = make(map[string]bool)
+		s.lists[list][userID] = set
+	}
+	if set[targetID] {
+		return true, nil
+	} else if len(set) >= max {
+		return false, nil
+	}
+	set[targetID] = true
+	return true, nil
+}
+
+func (s *memStore) RemoveFromList(list, userID, targetID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.lists[list][userID], targetID)
+	return nil
+}
+
+func (s *memStore) List(list, userID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids = make([]string, 0, len(s.lists[list][userID]))
+	for id := range s.lists[list][userID] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *memStore) ListedBy(list, targetID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids = make([]string, 0)
+	for userID, set := range s.lists[list] {
+		if set[targetID] {
+			ids = append(ids, userID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *memStore) InList(list, userID, targetID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lists[list][userID][targetID], nil
+}
+
+func (s *memStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memStore) Close(ctx context.Context) error {
+	return nil
+}
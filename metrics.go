@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are exposed at /metrics in Prometheus
+// text format. Every metric has labels; key of
+// value is its labels already formatted, so
+// {route="/reg",code="200"}
+
+// counter is counter with labels.
+// It's safe for concurrent use
+type counter struct {
+	name, help string
+	mu         sync.Mutex
+	vals       map[string]uint64
+}
+
+func newCounter(name, help string) *counter {
+	return &counter{name: name, help: help, vals: make(map[string]uint64)}
+}
+
+// Add adds n to value with labels
+// given as name, value pairs
+func (c *counter) Add(n uint64, labels ...string) {
+	key := formatLabels(labels)
+	c.mu.Lock()
+	c.vals[key] += n
+	c.mu.Unlock()
+}
+
+// Inc adds 1 to value with labels
+func (c *counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *counter) writeTo(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys = make([]string, 0, len(c.vals))
+	for key := range c.vals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, key, c.vals[key])
+	}
+}
+
+// defBuckets are upper bounds of histograms'
+// buckets in seconds; same as Prometheus' default
+var defBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogram is histogram of durations with labels.
+// It's safe for concurrent use
+type histogram struct {
+	name, help string
+	mu         sync.Mutex
+	vals       map[string]*histValue
+}
+
+func newHistogram(name, help string) *histogram {
+	return &histogram{name: name, help: help, vals: make(map[string]*histValue)}
+}
+
+// Observe adds duration d to value with labels
+func (h *histogram) Observe(d time.Duration, labels ...string) {
+	key := formatLabels(labels)
+	s := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.vals[key]
+	if !ok {
+		v = &histValue{counts: make([]uint64, len(defBuckets))}
+		h.vals[key] = v
+	}
+	for i, le := range defBuckets {
+		if s <= le {
+			v.counts[i]++
+		}
+	}
+	v.sum += s
+	v.count++
+}
+
+func (h *histogram) writeTo(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var keys = make([]string, 0, len(h.vals))
+	for key := range h.vals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := h.vals[key]
+		// le label is added to other ones
+		prefix := "{"
+		if key != "" {
+			prefix = key[:len(key)-1] + ","
+		}
+		for i, le := range defBuckets {
+			fmt.Fprintf(w, "%s_bucket%sle=\"%s\"} %d\n", h.name, prefix,
+				strconv.FormatFloat(le, 'g', -1, 64), v.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", h.name, prefix, v.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, key, v.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, v.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats name, value pairs
+// as {name="value",...}
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	mMessagesSent = newCounter("overmsg_messages_sent_total",
+		"Messages accepted for sending by kind (direct or group).")
+	mMessagesDelivered = newCounter("overmsg_messages_delivered_total",
+		"Messages written to recipients' connections by way (live, group or queue).")
+	mMessagesQueued = newCounter("overmsg_messages_queued_total",
+		"Messages queued for offline users.")
+	mMessagesFailed = newCounter("overmsg_messages_failed_total",
+		"Messages which weren't sent by reason.")
+	mRequests = newCounter("overmsg_http_requests_total",
+		"HTTP requests by route and status code.")
+	mRequestDuration = newHistogram("overmsg_http_request_duration_seconds",
+		"Latency of HTTP handlers by route.")
+	mStoreDuration = newHistogram("overmsg_mongo_command_duration_seconds",
+		"Latency of MongoDB commands by command name.")
+	mStoreFailed = newCounter("overmsg_mongo_command_failures_total",
+		"Failed MongoDB commands by command name.")
+)
+
+// sendFailReasons are reasons of failed sending by its code
+var sendFailReasons = map[int]string{
+	400: "invalid",
+	404: "not_found",
+	410: "queue_full",
+	413: "too_long",
+	500: "server_error",
+}
+
+// countSend counts result of sendMessage
+func countSend(req SendMessageRequest, code int, ans Answer) {
+	if !ans.Success {
+		reason, ok := sendFailReasons[code]
+		if !ok {
+			reason = strconv.Itoa(code)
+		}
+		mMessagesFailed.Inc("reason", reason)
+		return
+	}
+	res, ok := ans.Res.(SendMessageResult)
+	if !ok {
+		// message to yourself
+		return
+	}
+	if res.dropped {
+		mMessagesFailed.Inc("reason", "blocked")
+		return
+	}
+	if req.GroupID != "" {
+		mMessagesSent.Inc("kind", "group")
+		mMessagesDelivered.Add(uint64(res.Delivered), "way", "group")
+		return
+	}
+	mMessagesSent.Inc("kind", "direct")
+	switch res.Status {
+	case "delivered":
+		mMessagesDelivered.Inc("way", "live")
+	case "queued":
+		mMessagesQueued.Inc()
+	}
+}
+
+// knownRoutes are routes registered in router; other
+// paths are counted as "other", so random URLs don't
+// create new metrics
+var knownRoutes = make(map[string]bool)
+
+// statusWriter remembers status code of response
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = 200
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack is needed by WebSocket handler
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response doesn't support hijacking")
+	}
+	if w.code == 0 {
+		w.code = 101
+	}
+	return h.Hijack()
+}
+
+// measure calls serve and counts status code and
+// latency of response by route; it returns them
+func measure(w http.ResponseWriter, r *http.Request, serve func(http.ResponseWriter)) (int, time.Duration) {
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	serve(sw)
+	route := r.URL.Path
+	if !knownRoutes[route] {
+		route = "other"
+	}
+	if sw.code == 0 {
+		sw.code = 200
+	}
+	d := time.Since(start)
+	mRequestDuration.Observe(d, "route", route)
+	mRequests.Inc("route", route, "code", strconv.Itoa(sw.code))
+	return sw.code, d
+}
+
+// MetricsHandler writes metrics in Prometheus text format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(200)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	fmt.Fprintf(bw, "# HELP overmsg_connections Online users' connections.\n"+
+		"# TYPE overmsg_connections gauge\novermsg_connections %d\n", conns.Len())
+	for _, c := range []*counter{mMessagesSent, mMessagesDelivered,
+		mMessagesQueued, mMessagesFailed, mRequests, mStoreFailed} {
+		c.writeTo(bw)
+	}
+	for _, h := range []*histogram{mRequestDuration, mStoreDuration} {
+		h.writeTo(bw)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"regexp"
+	"time"
+)
+
+type mongoStore struct {
+	client   *mongo.Client
+	login    *mongo.Collection
+	sessions *mongo.Collection
+	queue    *mongo.Collection
+	messages *mongo.Collection
+	groups   *mongo.Collection
+	lists    *mongo.Collection
+	audit    *mongo.Collection
+}
+
+func newMongoStore(url string) (*mongoStore, error) {
+	client, err := mongo.NewClient(options.Client().ApplyURI(url).SetMonitor(&event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mStoreDuration.Observe(time.Duration(e.DurationNanos), "command", e.CommandName)
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mStoreDuration.Observe(time.Duration(e.DurationNanos), "command", e.CommandName)
+			mStoreFailed.Inc("command", e.CommandName)
+		},
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
+	}
+	db := client.Database("app")
+	s := &mongoStore{
+		client:   client,
+		login:    db.Collection("login"),
+		sessions: db.Collection("sessions"),
+		queue:    db.Collection("queue"),
+		messages: db.Collection("messages"),
+		groups:   db.Collection("groups"),
+		lists:    db.Collection("lists"),
+		audit:    db.Collection("audit"),
+	}
+	// mongo removes expired sessions and messages by itself
+	for _, c := range []*mongo.Collection{s.sessions, s.queue} {
+		if _, err := c.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.M{"expires_at": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.queue.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "to", Value: 1}, {Key: "created_at", Value: 1}},
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := s.messages.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "from", Value: 1}, {Key: "to", Value: 1}, {Key: "_id", Value: -1}},
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := s.messages.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "group", Value: 1}, {Key: "_id", Value: -1}},
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := s.groups.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"members.user_id": 1},
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := s.lists.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "list", Value: 1}, {Key: "user_id", Value: 1}}},
+		{Keys: bson.D{{Key: "list", Value: 1}, {Key: "target_id", Value: 1}}},
+	}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *mongoStore) findUser(filter bson.M) (us User, ok bool, err error) {
+	err = s.login.FindOne(ctx, filter).Decode(&us)
+	if err == mongo.ErrNoDocuments {
+		return us, false, nil
+	}
+	return us, err == nil, err
+}
+
+func (s *mongoStore) GetUserByName(name string) (User, bool, error) {
+	return s.findUser(bson.M{"name": name})
+}
+
+func (s *mongoStore) GetUserByID(id string) (User, bool, error) {
+	return s.findUser(bson.M{"_id": id})
+}
+
+func (s *mongoStore) ListUsers(query, after string, limit int) ([]User, error) {
+	var list = make([]User, 0)
+	cursor, err := s.login.Find(ctx, bson.M{"name": bson.M{
+		"$gt":      after,
+		"$regex":   regexp.QuoteMeta(query),
+		"$options": "i",
+	}}, options.Find().
+		SetSort(bson.D{{Key: "name", Value: 1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &list)
+	return list, err
+}
+
+func (s *mongoStore) CreateUser(us User) error {
+	_, err := s.login.InsertOne(ctx, us)
+	return err
+}
+
+func (s *mongoStore) SetUserHash(id, hash string) error {
+	_, err := s.login.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set":   bson.M{"hash": hash},
+		"$unset": bson.M{"pass": ""},
+	})
+	return err
+}
+
+func (s *mongoStore) SetUserRole(id, role string) error {
+	update := bson.M{"$set": bson.M{"role": role}}
+	if role == "" {
+		update = bson.M{"$unset": bson.M{"role": ""}}
+	}
+	_, err := s.login.UpdateOne(ctx, bson.M{"_id": id}, update)
+	return err
+}
+
+func (s *mongoStore) SetUserDisabled(id string, disabled bool) error {
+	update := bson.M{"$set": bson.M{"disabled": true}}
+	if !disabled {
+		update = bson.M{"$unset": bson.M{"disabled": ""}}
+	}
+	_, err := s.login.UpdateOne(ctx, bson.M{"_id": id}, update)
+	return err
+}
+
+func (s *mongoStore) DeleteUser(id string) error {
+	if _, err := s.login.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return err
+	}
+	if err := s.DeleteSessions(id); err != nil {
+		return err
+	}
+	if _, err := s.queue.DeleteMany(ctx, bson.M{"to": id}); err != nil {
+		return err
+	}
+	_, err := s.lists.DeleteMany(ctx, bson.M{"$or": bson.A{
+		bson.M{"user_id": id},
+		bson.M{"target_id": id},
+	}})
+	return err
+}
+
+func (s *mongoStore) DeleteSessions(userID string) error {
+	_, err := s.sessions.DeleteMany(ctx, bson.M{"user_id": userID})
+	return err
+}
+
+func (s *mongoStore) AddAudit(e AuditEntry) error {
+	_, err := s.audit.InsertOne(ctx, e)
+	return err
+}
+
+func (s *mongoStore) AuditLog(before string, limit int) ([]AuditEntry, error) {
+	var filter = bson.M{}
+	if before != "" {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	var list = make([]AuditEntry, 0)
+	cursor, err := s.audit.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &list)
+	return list, err
+}
+
+func (s *mongoStore) CreateSession(sess Session) error {
+	_, err := s.sessions.InsertOne(ctx, sess)
+	return err
+}
+
+func (s *mongoStore) TouchSession(id string, now time.Time) (sess Session, ok bool, err error) {
+	err = s.sessions.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "expires_at": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"last_used": now}},
+	).Decode(&sess)
+	if err == mongo.ErrNoDocuments {
+		return sess, false, nil
+	}
+	return sess, err == nil, err
+}
+
+func (s *mongoStore) ListSessions(userID string, now time.Time) ([]Session, error) {
+	var list = make([]Session, 0)
+	cursor, err := s.sessions.Find(ctx, bson.M{
+		"user_id":    userID,
+		"expires_at": bson.M{"$gt": now},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &list)
+	return list, err
+}
+
+func (s *mongoStore) DeleteSession(id, userID string) (bool, error) {
+	res, err := s.sessions.DeleteOne(ctx, bson.M{"_id": id, "user_id": userID})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount != 0, nil
+}
+
+func (s *mongoStore) QueueMessage(m QueuedMessage, max int) (bool, error) {
+	c, err := s.queue.CountDocuments(ctx, bson.M{
+		"to":         m.To,
+		"expires_at": bson.M{"$gt": m.Created},
+	})
+	if err != nil {
+		return false, err
+	} else if c >= int64(max) {
+		return false, nil
+	}
+	_, err = s.queue.InsertOne(ctx, m)
+	return err == nil, err
+}
+
+func (s *mongoStore) QueuedMessages(to string, now time.Time) ([]QueuedMessage, error) {
+	var list = make([]QueuedMessage, 0)
+	cursor, err := s.queue.Find(ctx, bson.M{
+		"to":         to,
+		"expires_at": bson.M{"$gt": now},
+	}, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &list)
+	return list, err
+}
+
+func (s *mongoStore) DeleteQueued(ids []string) error {
+	_, err := s.queue.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+func (s *mongoStore) SaveMessage(m StoredMessage) error {
+	_, err := s.messages.InsertOne(ctx, m)
+	return err
+}
+
+func (s *mongoStore) DeleteMessage(id string) error {
+	_, err := s.messages.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (s *mongoStore) SetReceipt(to string, ids []string, status string, t time.Time) ([]StoredMessage, error) {
+	field := status + "_at"
+	filter := bson.M{
+		"_id": bson.M{"$in": ids},
+		"to":  to,
+		field: bson.M{"$exists": false},
+	}
+	var list = make([]StoredMessage, 0)
+	cursor, err := s.messages.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	} else if err = cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	if _, err = s.messages.UpdateMany(ctx, filter, bson.M{"$set": bson.M{field: t}}); err != nil {
+		return nil, err
+	}
+	if status == "read" {
+		_, err = s.messages.UpdateMany(ctx, bson.M{
+			"_id":          bson.M{"$in": ids},
+			"to":           to,
+			"delivered_at": bson.M{"$exists": false},
+		}, bson.M{"$set": bson.M{"delivered_at": t}})
+	}
+	return list, err
+}
+
+func (s *mongoStore) History(a, b, before string, limit int) ([]StoredMessage, error) {
+	return s.history(bson.M{"$or": bson.A{
+		bson.M{"from": a, "to": b},
+		bson.M{"from": b, "to": a},
+	}}, before, limit)
+}
+
+func (s *mongoStore) GroupHistory(groupID, before string, limit int) ([]StoredMessage, error) {
+	return s.history(bson.M{"group": groupID}, before, limit)
+}
+
+func (s *mongoStore) history(filter bson.M, before string, limit int) ([]StoredMessage, error) {
+	if before != "" {
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	var list = make([]StoredMessage, 0)
+	cursor, err := s.messages.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &list)
+	return list, err
+}
+
+func (s *mongoStore) CreateGroup(g Group) error {
+	_, err := s.groups.InsertOne(ctx, g)
+	return err
+}
+
+func (s *mongoStore) GetGroup(id string) (g Group, ok bool, err error) {
+	err = s.groups.FindOne(ctx, bson.M{"_id": id}).Decode(&g)
+	if err == mongo.ErrNoDocuments {
+		return g, false, nil
+	}
+	return g, err == nil, err
+}
+
+func (s *mongoStore) UpdateGroup(g Group) (bool, error) {
+	var version interface{} = g.Version
+	if g.Version == 0 {
+		// groups made before versions have no field
+		version = bson.M{"$in": bson.A{0, nil}}
+	}
+	g.Version++
+	res, err := s.groups.ReplaceOne(ctx, bson.M{"_id": g.ID, "version": version}, g)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+func (s *mongoStore) DeleteGroup(id string) error {
+	_, err := s.groups.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (s *mongoStore) GroupsOf(userID string) ([]Group, error) {
+	var list = make([]Group, 0)
+	cursor, err := s.groups.Find(ctx, bson.M{"members.user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &list)
+	return list, err
+}
+
+func (s *mongoStore) SetLastSeen(userID string, t time.Time) error {
+	_, err := s.login.UpdateOne(ctx, bson.M{"_id": userID},
+		bson.M{"$set": bson.M{"last_seen": t}})
+	return err
+}
+
+// list item ids are list:user_id:target_id,
+// so adding twice changes nothing
+func listItemID(list, userID, targetID string) string {
+	return list + ":" + userID + ":" + targetID
+}
+
+func (s *mongoStore) AddToList(list, userID, targetID string, max int) (bool, error) {
+	id := listItemID(list, userID, targetID)
+	if c, err := s.lists.CountDocuments(ctx, bson.M{"_id": id}); err != nil {
+		return false, err
+	} else if c != 0 {
+		return true, nil
+	}
+	c, err := s.lists.CountDocuments(ctx, bson.M{"list": list, "user_id": userID})
+	if err != nil {
+		return false, err
+	} else if c >= int64(max) {
+		return false, nil
+	}
+	_, err = s.lists.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"list":      list,
+		"user_id":   userID,
+		"target_id": targetID,
+	}}, options.Update().SetUpsert(true))
+	return err == nil, err
+}
+
+func (s *mongoStore) RemoveFromList(list, userID, targetID string) error {
+	_, err := s.lists.DeleteOne(ctx, bson.M{"_id": listItemID(list, userID, targetID)})
+	return err
+}
+
+func (s *mongoStore) listField(filter bson.M, field string) ([]string, error) {
+	cursor, err := s.lists.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	var ids = make([]string, 0, len(docs))
+	for _, d := range docs {
+		if id, ok := d[field].(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *mongoStore) List(list, userID string) ([]string, error) {
+	return s.listField(bson.M{"list": list, "user_id": userID}, "target_id")
+}
+
+func (s *mongoStore) ListedBy(list, targetID string) ([]string, error) {
+	return s.listField(bson.M{"list": list, "target_id": targetID}, "user_id")
+}
+
+func (s *mongoStore) InList(list, userID, targetID string) (bool, error) {
+	c, err := s.lists.CountDocuments(ctx, bson.M{"_id": listItemID(list, userID, targetID)})
+	return c != 0, err
+}
+
+func (s *mongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+func (s *mongoStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, readpref.Primary())
+}
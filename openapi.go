@@ -0,0 +1,372 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routeDoc describes route in OpenAPI document
+type routeDoc struct {
+	Method  string
+	Summary string
+	// Auth routes need Auth-Token header
+	Auth bool
+	// Req and Res are zero values of types of request
+	// body and of result; nil if route has no ones
+	Req, Res interface{}
+	// Status is code of success; it's 200 if 0
+	Status int
+	// Query are names of query parameters
+	Query []string
+	// Raw is content type of non-JSON answer
+	Raw string
+	// Unversioned routes aren't served under /v1
+	Unversioned bool
+}
+
+// routeDocs are docs of every route registered in
+// runServer; TestOpenAPIRoutes fails if any is missing
+var routeDocs = map[string]routeDoc{
+	"/reg":          {Method: "POST", Summary: "Register user and get token", Req: RegRequest{}, Res: TokenResult{}, Status: 201},
+	"/get_token":    {Method: "POST", Summary: "Get token by name and password", Req: AuthRequest{}, Res: TokenResult{}},
+	"/go_offline":   {Method: "POST", Summary: "Close connection of user; session stays valid", Auth: true},
+	"/send_message": {Method: "POST", Summary: "Send message to user or group", Auth: true, Req: SendMessageRequest{}, Res: SendMessageResult{}},
+	"/ack":          {Method: "POST", Summary: "Mark messages as delivered or read", Auth: true, Req: AckRequest{}},
+	"/typing":       {Method: "POST", Summary: "Send typing state to user or group", Auth: true, Req: TypingRequest{}, Res: TypingResult{}},
+	"/is_online":    {Method: "POST", Summary: "Tell if user is online", Auth: true, Req: IsOnlineRequest{}, Res: IsOnlineResult{}},
+	"/heartbeat":    {Method: "POST", Summary: "Keep connection alive; body is token", Raw: "text/plain"},
+	"/allowed_syms": {Method: "GET", Summary: "Symbols allowed in names", Raw: "text/plain"},
+	"/history": {Method: "GET", Summary: "Page of conversation, newest messages first", Auth: true, Res: HistoryResult{},
+		Query: []string{"peer", "group", "before", "limit"}},
+	"/ws": {Method: "GET", Summary: "WebSocket transport: first frame is token, then same lines as TCP protocol",
+		Status: 101, Unversioned: true},
+	"/groups":         {Method: "POST", Summary: "Groups of user", Auth: true, Res: GroupsResult{}},
+	"/create_group":   {Method: "POST", Summary: "Create group", Auth: true, Req: CreateGroupRequest{}, Res: GroupResult{}},
+	"/group_invite":   {Method: "POST", Summary: "Add member to group", Auth: true, Req: GroupMemberRequest{}, Res: GroupResult{}},
+	"/group_remove":   {Method: "POST", Summary: "Remove member from group", Auth: true, Req: GroupMemberRequest{}, Res: GroupResult{}},
+	"/leave_group":    {Method: "POST", Summary: "Leave group", Auth: true, Req: GroupRequest{}},
+	"/rename_group":   {Method: "POST", Summary: "Rename group", Auth: true, Req: RenameGroupRequest{}, Res: GroupResult{}},
+	"/group_role":     {Method: "POST", Summary: "Set role of group member", Auth: true, Req: GroupRoleRequest{}, Res: GroupResult{}},
+	"/subscribe":      {Method: "POST", Summary: "Subscribe to presence of user", Auth: true, Req: ListRequest{}, Res: Presence{}},
+	"/unsubscribe":    {Method: "POST", Summary: "Unsubscribe from presence of user", Auth: true, Req: ListRequest{}, Res: Presence{}},
+	"/subscriptions":  {Method: "POST", Summary: "Presence of users in subscriptions", Auth: true, Res: SubscriptionsResult{}},
+	"/contacts":       {Method: "POST", Summary: "Contacts of user", Auth: true, Res: UsersResult{}},
+	"/add_contact":    {Method: "POST", Summary: "Add user to contacts", Auth: true, Req: ListRequest{}},
+	"/remove_contact": {Method: "POST", Summary: "Remove user from contacts", Auth: true, Req: ListRequest{}},
+	"/blocked":        {Method: "POST", Summary: "Users blocked by user", Auth: true, Res: UsersResult{}},
+	"/block":          {Method: "POST", Summary: "Block user", Auth: true, Req: ListRequest{}},
+	"/unblock":        {Method: "POST", Summary: "Unblock user", Auth: true, Req: ListRequest{}},
+	"/sessions":       {Method: "POST", Summary: "Sessions of user", Auth: true, Res: SessionsResult{}},
+	"/revoke_session": {Method: "POST", Summary: "Delete session by id", Auth: true, Req: RevokeSessionRequest{}},
+
+	"/admin/users":          {Method: "POST", Summary: "List or search users (admin)", Auth: true, Req: AdminUsersRequest{}, Res: AdminUsersResult{}},
+	"/admin/disable":        {Method: "POST", Summary: "Disable user (admin)", Auth: true, Req: AdminUserRequest{}},
+	"/admin/enable":         {Method: "POST", Summary: "Enable user (admin)", Auth: true, Req: AdminUserRequest{}},
+	"/admin/delete_user":    {Method: "POST", Summary: "Delete user (admin)", Auth: true, Req: AdminUserRequest{}},
+	"/admin/disconnect":     {Method: "POST", Summary: "Close connection of user (admin)", Auth: true, Req: AdminUserRequest{}},
+	"/admin/reset_password": {Method: "POST", Summary: "Set new password of user (admin)", Auth: true, Req: AdminUserRequest{}, Res: PassResult{}},
+	"/admin/set_role":       {Method: "POST", Summary: "Set role of user (admin)", Auth: true, Req: AdminUserRequest{}},
+	"/admin/audit":          {Method: "POST", Summary: "Audit log, newest first (admin)", Auth: true, Req: AuditRequest{}, Res: AuditResult{}},
+
+	"/metrics":      {Method: "GET", Summary: "Metrics in Prometheus text format", Raw: "text/plain", Unversioned: true},
+	"/healthz":      {Method: "GET", Summary: "Tell that process is alive", Res: HealthResult{}, Unversioned: true},
+	"/readyz":       {Method: "GET", Summary: "Tell if server can serve users; 503 if not", Res: HealthResult{}, Unversioned: true},
+	"/openapi.json": {Method: "GET", Summary: "This document", Raw: "application/json", Unversioned: true},
+	"/":             {Method: "GET", Summary: "Info page", Raw: "text/html", Unversioned: true},
+}
+
+// openAPIDoc is encoded document served at /openapi.json
+var openAPIDoc []byte
+
+// initOpenAPI encodes document; routes
+// are compared with routeDocs by tests
+func initOpenAPI() error {
+	var err error
+	openAPIDoc, err = json.Marshal(buildOpenAPI())
+	return err
+}
+
+// OpenAPIHandler serves OpenAPI document
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(openAPIDoc)
+}
+
+// jsonObj is object of OpenAPI document
+type jsonObj = map[string]interface{}
+
+// specBuilder collects schemas of types used in routes
+type specBuilder struct {
+	schemas jsonObj
+}
+
+// buildOpenAPI returns OpenAPI 3 document made of routeDocs
+func buildOpenAPI() jsonObj {
+	b := specBuilder{schemas: jsonObj{}}
+	var codes []string
+	// fallback of writeAnswer
+	seen := map[string]bool{"error": true}
+	for _, c := range errorCodes {
+		seen[c] = true
+	}
+	for _, c := range statusCodes {
+		seen[c] = true
+	}
+	for c := range seen {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	b.schemas["ErrorCode"] = jsonObj{"type": "string", "enum": codes}
+	b.schemas["Answer"] = jsonObj{
+		"type":        "object",
+		"description": "Answer of unversioned routes",
+		"required":    []string{"succes"},
+		"properties": jsonObj{
+			"succes": jsonObj{"type": "boolean"},
+			"error":  jsonObj{"type": "string"},
+			"result": jsonObj{},
+		},
+	}
+	b.schemas["V1Answer"] = jsonObj{
+		"type":        "object",
+		"description": "Answer of /v1 routes",
+		"required":    []string{"success"},
+		"properties": jsonObj{
+			"success": jsonObj{"type": "boolean"},
+			"code":    ref("ErrorCode"),
+			"error":   jsonObj{"type": "string"},
+			"result":  jsonObj{},
+		},
+	}
+	paths := jsonObj{}
+	for path, d := range routeDocs {
+		if d.Unversioned {
+			paths[path] = jsonObj{strings.ToLower(d.Method): b.operation(d, "Answer", false)}
+			continue
+		}
+		paths[path] = jsonObj{strings.ToLower(d.Method): b.operation(d, "Answer", true)}
+		paths[apiV1+path] = jsonObj{strings.ToLower(d.Method): b.operation(d, "V1Answer", false)}
+	}
+	return jsonObj{
+		"openapi": "3.0.3",
+		"info": jsonObj{
+			"title":   "overmsg-server",
+			"version": "1",
+			"description": "Every API route is served with /v1 prefix too; unversioned " +
+				"ones are kept for old clients and answer with misspelled succes key",
+		},
+		"paths": paths,
+		"components": jsonObj{
+			"schemas": b.schemas,
+			"securitySchemes": jsonObj{
+				"token": jsonObj{"type": "apiKey", "in": "header", "name": "Auth-Token"},
+			},
+			"headers": jsonObj{
+				"X-Request-ID": jsonObj{
+					"description": "id of request in logs; taken from request if it's set",
+					"schema":      jsonObj{"type": "string"},
+				},
+				"Retry-After": jsonObj{
+					"description": "seconds to wait",
+					"schema":      jsonObj{"type": "integer"},
+				},
+			},
+		},
+	}
+}
+
+func ref(name string) jsonObj {
+	return jsonObj{"$ref": "#/components/schemas/" + name}
+}
+
+// operation describes route with answer of given schema
+func (b specBuilder) operation(d routeDoc, answer string, deprecated bool) jsonObj {
+	op := jsonObj{"summary": d.Summary}
+	if deprecated {
+		op["deprecated"] = true
+	}
+	if d.Auth {
+		op["security"] = []jsonObj{{"token": []string{}}}
+	}
+	var params []jsonObj
+	for _, q := range d.Query {
+		params = append(params, jsonObj{"name": q, "in": "query", "schema": jsonObj{"type": "string"}})
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+	if d.Req != nil {
+		op["requestBody"] = jsonObj{
+			"required": true,
+			"content":  jsonObj{"application/json": jsonObj{"schema": b.schema(reflect.TypeOf(d.Req))}},
+		}
+	} else if d.Raw == "text/plain" && d.Method == "POST" {
+		op["requestBody"] = jsonObj{
+			"required": true,
+			"content":  jsonObj{"text/plain": jsonObj{"schema": jsonObj{"type": "string"}}},
+		}
+	}
+	status := d.Status
+	if status == 0 {
+		status = 200
+	}
+	headers := jsonObj{"X-Request-ID": jsonObj{"$ref": "#/components/headers/X-Request-ID"}}
+	ok := jsonObj{"description": http.StatusText(status), "headers": headers}
+	switch {
+	case d.Raw != "":
+		ok["content"] = jsonObj{d.Raw: jsonObj{"schema": jsonObj{"type": "string"}}}
+	case status == 101:
+	case d.Res != nil:
+		ok["content"] = jsonObj{"application/json": jsonObj{"schema": jsonObj{"allOf": []jsonObj{
+			ref(answer),
+			{"properties": jsonObj{"result": b.schema(reflect.TypeOf(d.Res))}},
+		}}}}
+	default:
+		ok["content"] = jsonObj{"application/json": jsonObj{"schema": ref(answer)}}
+	}
+	responses := jsonObj{
+		strconv.Itoa(status): ok,
+		"429": jsonObj{
+			"description": "Too many requests",
+			"headers": jsonObj{
+				"X-Request-ID": jsonObj{"$ref": "#/components/headers/X-Request-ID"},
+				"Retry-After":  jsonObj{"$ref": "#/components/headers/Retry-After"},
+			},
+			"content": jsonObj{"application/json": jsonObj{"schema": ref(answer)}},
+		},
+	}
+	// errors of other routes are plain text
+	if d.Raw == "" && status != 101 {
+		responses["default"] = jsonObj{
+			"description": "Error",
+			"headers":     headers,
+			"content":     jsonObj{"application/json": jsonObj{"schema": ref(answer)}},
+		}
+	}
+	op["responses"] = responses
+	return op
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schema returns schema of type; structs are
+// added to components and referenced
+func (b specBuilder) schema(t reflect.Type) jsonObj {
+	if t == timeType {
+		return jsonObj{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := b.schema(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			return jsonObj{"allOf": []jsonObj{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.String:
+		return jsonObj{"type": "string"}
+	case reflect.Bool:
+		return jsonObj{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return jsonObj{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonObj{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return jsonObj{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonObj{"type": "string", "format": "byte"}
+		}
+		return jsonObj{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return jsonObj{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := b.schemas[t.Name()]; !ok {
+			// placeholder stops recursion
+			b.schemas[t.Name()] = jsonObj{}
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return ref(t.Name())
+	}
+	return jsonObj{}
+}
+
+// structSchema describes fields of struct as they're encoded
+func (b specBuilder) structSchema(t reflect.Type) jsonObj {
+	props := jsonObj{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+		if tag := f.Tag.Get("validate"); tag != "" {
+			if rules(props[name].(jsonObj), f.Type.Kind(), tag) {
+				required = append(required, name)
+			}
+		}
+	}
+	res := jsonObj{"type": "object", "properties": props}
+	if required != nil {
+		res["required"] = required
+	}
+	return res
+}
+
+// rules adds rules of validate tag to schema
+// of field; it tells if field is required
+func rules(s jsonObj, kind reflect.Kind, tag string) (required bool) {
+	min, max := "minLength", "maxLength"
+	if kind == reflect.Slice {
+		min, max = "minItems", "maxItems"
+	}
+	// fields with unless rule are required only
+	// without other one, which schema can't tell
+	var unless bool
+	for _, rule := range strings.Split(tag, ",") {
+		arg := ""
+		if i := strings.IndexByte(rule, '='); i != -1 {
+			rule, arg = rule[:i], rule[i+1:]
+		}
+		switch rule {
+		case "unless":
+			unless = true
+		case "required":
+			required = !unless
+			if _, ok := s[min]; !ok {
+				s[min] = 1
+			}
+		case "notblank":
+			required = !unless
+			s["pattern"] = `\S`
+		case "oneof":
+			s["enum"] = strings.Fields(arg)
+		case "min":
+			s[min] = mustAtoi(arg, "")
+		case "max":
+			s[max] = mustAtoi(arg, "")
+		case "charset":
+			s["pattern"] = "^[" + strings.ReplaceAll(regexp.QuoteMeta(charsets[arg]), "-", `\-`) + "]*$"
+		}
+	}
+	return required
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestOpenAPIRoutes(t *testing.T) {
+	registered := make(map[string]bool)
+	newRouter().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		// route of /v1 subrouter has no handler
+		if path, err := route.GetPathTemplate(); err == nil && route.GetHandler() != nil {
+			registered[path] = true
+		}
+		return nil
+	})
+	paths := buildOpenAPI()["paths"].(jsonObj)
+	var missing, stale []string
+	for path := range registered {
+		if _, ok := paths[path]; !ok {
+			missing = append(missing, path)
+		}
+	}
+	for path := range paths {
+		if !registered[path] {
+			stale = append(stale, path)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(stale)
+	if len(missing) != 0 {
+		t.Errorf("routes aren't described in routeDocs: %v", missing)
+	}
+	if len(stale) != 0 {
+		t.Errorf("routeDocs describe unregistered routes: %v", stale)
+	}
+}
+
+func TestOpenAPIEncodes(t *testing.T) {
+	if err := initOpenAPI(); err != nil {
+		t.Fatal(err)
+	}
+}
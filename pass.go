@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	algoArgon2id = "argon2id"
+	algoBcrypt   = "bcrypt"
+	saltLen      = 16
+	argon2KeyLen = 32
+)
+
+var errBadHash = errors.New("bad password hash format")
+
+// hashPass hashes password using algorithm
+// and parameters from conf.Pass
+func hashPass(pass string) (string, error) {
+	switch conf.Pass.Algo {
+	case algoBcrypt:
+		h, err := bcrypt.GenerateFromPassword([]byte(pass), conf.Pass.BcryptCost)
+		return string(h), err
+	case algoArgon2id:
+		salt := make([]byte, saltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		a := conf.Pass.Argon2
+		key := argon2.IDKey([]byte(pass), salt,
+			uint32(a.Time), uint32(a.Memory), uint8(a.Threads), argon2KeyLen)
+		return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			algoArgon2id, argon2.Version, a.Memory, a.Time, a.Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	}
+	return "", fmt.Errorf("unknown password algorithm %q", conf.Pass.Algo)
+}
+
+// checkPass compares pass with user's stored password.
+// rehash is true if password matches but stored value
+// is legacy plaintext or was made with other parameters
+func checkPass(us User, pass string) (ok, rehash bool, err error) {
+	if us.Hash == "" {
+		// legacy record with plaintext password
+		if us.Pass == "" {
+			return false, false, nil
+		}
+		ok = subtle.ConstantTimeCompare([]byte(us.Pass), []byte(pass)) == 1
+		return ok, ok, nil
+	}
+	switch {
+	case strings.HasPrefix(us.Hash, "$"+algoArgon2id+"$"):
+		var (
+			ver, iters, mem, threads uint
+			salt, key                []byte
+		)
+		parts := strings.Split(us.Hash, "$")
+		if len(parts) != 6 {
+			return false, false, errBadHash
+		}
+		if _, err := fmt.Sscanf(parts[2], "v=%d", &ver); err != nil {
+			return false, false, errBadHash
+		} else if ver != argon2.Version {
+			return false, false, fmt.Errorf("unsupported argon2 version %d", ver)
+		}
+		if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mem, &iters, &threads); err != nil {
+			return false, false, errBadHash
+		}
+		if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+			return false, false, errBadHash
+		}
+		if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+			return false, false, errBadHash
+		}
+		got := argon2.IDKey([]byte(pass), salt,
+			uint32(iters), uint32(mem), uint8(threads), uint32(len(key)))
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return false, false, nil
+		}
+		a := conf.Pass.Argon2
+		rehash = conf.Pass.Algo != algoArgon2id ||
+			mem != a.Memory || iters != a.Time || threads != a.Threads
+		return true, rehash, nil
+	case strings.HasPrefix(us.Hash, "$2"):
+		err := bcrypt.CompareHashAndPassword([]byte(us.Hash), []byte(pass))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		} else if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(us.Hash))
+		if err != nil {
+			return false, false, err
+		}
+		rehash = conf.Pass.Algo != algoBcrypt || cost != conf.Pass.BcryptCost
+		return true, rehash, nil
+	}
+	return false, false, errBadHash
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// setPass sets password parameters of conf
+func setPass(algo string, cost int, time, memory uint) {
+	conf.Pass.Algo = algo
+	conf.Pass.BcryptCost = cost
+	conf.Pass.Argon2.Time, conf.Pass.Argon2.Memory, conf.Pass.Argon2.Threads = time, memory, 1
+}
+
+func TestHashPassRoundTrip(t *testing.T) {
+	tests := []struct {
+		algo   string
+		prefix string
+	}{
+		{algoArgon2id, "$argon2id$v=19$m=64,t=1,p=1$"},
+		{algoBcrypt, "$2a$04$"},
+	}
+	for _, tt := range tests {
+		setPass(tt.algo, 4, 1, 64)
+		hash, err := hashPass("pass")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.algo, err)
+		} else if !strings.HasPrefix(hash, tt.prefix) {
+			t.Fatalf("%s hash = %q, want prefix %q", tt.algo, hash, tt.prefix)
+		}
+		us := User{Hash: hash}
+		if ok, rehash, err := checkPass(us, "pass"); !ok || rehash || err != nil {
+			t.Errorf("%s right pass = %v %v %v, want true false nil", tt.algo, ok, rehash, err)
+		}
+		if ok, rehash, err := checkPass(us, "wrong"); ok || rehash || err != nil {
+			t.Errorf("%s wrong pass = %v %v %v, want false false nil", tt.algo, ok, rehash, err)
+		}
+	}
+	setPass("md5", 0, 0, 0)
+	if _, err := hashPass("pass"); err == nil {
+		t.Error("unknown algorithm is accepted")
+	}
+}
+
+func TestCheckPass(t *testing.T) {
+	setPass(algoArgon2id, 4, 1, 64)
+	argon, _ := hashPass("pass")
+	setPass(algoBcrypt, 4, 1, 64)
+	bcrypted, _ := hashPass("pass")
+	tests := []struct {
+		name       string
+		us         User
+		pass       string
+		algo       string
+		cost       int
+		time       uint
+		ok, rehash bool
+		err        bool
+	}{
+		{"plaintext", User{Pass: "pass"}, "pass", algoArgon2id, 4, 1, true, true, false},
+		{"plaintext wrong", User{Pass: "pass"}, "wrong", algoArgon2id, 4, 1, false, false, false},
+		{"no password", User{}, "", algoArgon2id, 4, 1, false, false, false},
+		{"argon2 same", User{Hash: argon}, "pass", algoArgon2id, 4, 1, true, false, false},
+		{"argon2 other time", User{Hash: argon}, "pass", algoArgon2id, 4, 2, true, true, false},
+		{"argon2 to bcrypt", User{Hash: argon}, "pass", algoBcrypt, 4, 1, true, true, false},
+		{"argon2 wrong", User{Hash: argon}, "wrong", algoArgon2id, 4, 2, false, false, false},
+		{"bcrypt same", User{Hash: bcrypted}, "pass", algoBcrypt, 4, 1, true, false, false},
+		{"bcrypt other cost", User{Hash: bcrypted}, "pass", algoBcrypt, 5, 1, true, true, false},
+		{"bcrypt to argon2", User{Hash: bcrypted}, "pass", algoArgon2id, 4, 1, true, true, false},
+		{"bad hash", User{Hash: "$argon2id$v=19$m=64"}, "pass", algoArgon2id, 4, 1, false, false, true},
+		{"bad salt", User{Hash: "$argon2id$v=19$m=64,t=1,p=1$!$AAAA"}, "pass", algoArgon2id, 4, 1, false, false, true},
+		{"unknown hash", User{Hash: "pass"}, "pass", algoArgon2id, 4, 1, false, false, true},
+	}
+	for _, tt := range tests {
+		setPass(tt.algo, tt.cost, tt.time, 64)
+		ok, rehash, err := checkPass(tt.us, tt.pass)
+		if ok != tt.ok || rehash != tt.rehash || (err != nil) != tt.err {
+			t.Errorf("%s = %v %v %v, want %v %v, error %v", tt.name, ok, rehash, err, tt.ok, tt.rehash, tt.err)
+		}
+	}
+}
+
+func TestLegacyPassMigration(t *testing.T) {
+	h := testServer()
+	if err := store.CreateUser(User{ID: "id", Name: "olduser", Pass: "pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if code, ans := call(t, h, "POST", "/get_token", "", `{"name":"olduser","pass":"pass"}`); code != 200 {
+		t.Fatalf("/get_token = %d %+v", code, ans)
+	}
+	us, _, _ := store.GetUserByID("id")
+	if us.Pass != "" || !strings.HasPrefix(us.Hash, "$argon2id$") {
+		t.Fatalf("user after login has pass %q and hash %q", us.Pass, us.Hash)
+	}
+	if ok, rehash, _ := checkPass(us, "pass"); !ok || rehash {
+		t.Fatalf("migrated hash = %v %v", ok, rehash)
+	}
+}
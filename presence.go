@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// notifyPresence pushes presence event about user
+// to online subscribers of user who aren't blocked
+func notifyPresence(l *logger, us User, online bool) {
+	ids, err := store.ListedBy(listSubscriptions, us.ID)
+	if err != nil {
+		l.Error("getting subscribers", "err", err)
+		return
+	}
+	for _, id := range ids {
+		if blocked, err := isBlocked(id, us.ID); err != nil {
+			l.Error("checking block", "err", err)
+			continue
+		} else if blocked {
+			continue
+		}
+		push(id, Event{Type: evPresence, From: us.Name, Online: &online})
+	}
+}
+
+// subscribe subscribes user with userID to presence
+// of user with name or unsubscribes if on is false
+func subscribe(l *logger, userID string, req ListRequest, on bool) (int, Answer) {
+	us, code, ans := changeList(l, listSubscriptions, userID, req, on)
+	if !ans.Success || !on {
+		return code, ans
+	}
+	p, err := presenceOf(userID, us)
+	if err != nil {
+		l.Error("server-side error", "err", err)
+		return 500, Answer{false, codeInternal, "Server-side error", nil}
+	}
+	return 200, Answer{true, "", "", p}
+}
+
+// presenceOf returns presence of user seen by user
+// with viewerID; blocked viewer always sees user
+// offline with last_seen, like any offline one
+func presenceOf(viewerID string, us User) (Presence, error) {
+	p := Presence{Name: us.Name}
+	blocked, err := isBlocked(viewerID, us.ID)
+	if err != nil {
+		return p, err
+	}
+	if !blocked {
+		_, p.Online = conns.Get(us.ID)
+	}
+	if !p.Online {
+		p.LastSeen = us.LastSeen
+	}
+	return p, nil
+}
+
+// SubscribeHandler subscribes user to presence of other one
+func SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	subscribeHandler(w, r, true)
+}
+
+// UnsubscribeHandler unsubscribes user from presence of other one
+func UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	subscribeHandler(w, r, false)
+}
+
+func subscribeHandler(w http.ResponseWriter, r *http.Request, on bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	var req ListRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	code, ans := subscribe(reqLog(r), sess.UserID, req, on)
+	w.WriteHeader(code)
+	writeAnswer(w, ans)
+}
+
+// SubscriptionsHandler returns presence of all
+// users whom user is subscribed to
+func SubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	sess, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	users, err := listUsers(listSubscriptions, sess.UserID)
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	var list = make([]Presence, len(users))
+	for i, us := range users {
+		if list[i], err = presenceOf(sess.UserID, us); err != nil {
+			w.WriteHeader(500)
+			reqLog(r).Error("server-side error", "err", err)
+			writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+			return
+		}
+	}
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", SubscriptionsResult{list}})
+}
+
+// wentOffline saves time when user was seen last
+// time and notifies subscribers
+func wentOffline(l *logger, us User) {
+	if err := store.SetLastSeen(us.ID, time.Now()); err != nil {
+		l.Error("setting last_seen", "err", err)
+	}
+	notifyPresence(l, us, false)
+}
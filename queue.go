@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"time"
+)
+
+// queueMessage saves message for offline user.
+// ok is false if user's queue is full
+func queueMessage(sm StoredMessage) (bool, error) {
+	return store.QueueMessage(QueuedMessage{
+		ID:      sm.ID,
+		To:      sm.To,
+		From:    sm.FromName,
+		Message: sm.Message,
+		Created: sm.Created,
+		Expires: sm.Created.Add(time.Duration(conf.Queue.TTL) * time.Second),
+	}, conf.Queue.Max)
+}
+
+// flushTo flushes queue of user to connection; wmu is
+// held, so it's serialized with flush of serveConn
+// and messages aren't written twice
+func flushTo(userID string, c *cConn) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return flushQueue(userID, lockedConn{c})
+}
+
+// flushQueue writes messages queued for user
+// to w in order they were sent; messages are
+// removed from queue only after successful write
+func flushQueue(userID string, w io.Writer) error {
+	list, err := store.QueuedMessages(userID, time.Now())
+	if err != nil {
+		return err
+	}
+	var sent = make([]string, 0, len(list))
+	for _, qm := range list {
+		if _, err = w.Write(Message{
+			ID:      qm.ID,
+			From:    qm.From,
+			Message: qm.Message,
+			Time:    qm.Created,
+		}.ToJSON()); err != nil {
+			break
+		}
+		sent = append(sent, qm.ID)
+	}
+	if len(sent) != 0 {
+		mMessagesDelivered.Add(uint64(len(sent)), "way", "queue")
+		if derr := store.DeleteQueued(sent); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return err
+}
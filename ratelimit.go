@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateConf is token bucket limit: Rate
+// requests per second with bursts of Burst
+type rateConf struct {
+	Rate  float64 `toml:"rate"`
+	Burst uint    `toml:"burst"`
+}
+
+// rateLimitConf is [ratelimit] section of config
+type rateLimitConf struct {
+	Disabled bool `toml:"disabled"`
+	// IP limits all requests from remote IP
+	IP rateConf `toml:"ip"`
+	// Token limits all requests and TCP
+	// commands of one session
+	Token rateConf `toml:"token"`
+	// Routes limits requests to route by session
+	// or by IP if request has no valid token
+	Routes  map[string]rateConf `toml:"routes"`
+	Lockout struct {
+		// After is count of wrong passwords in
+		// a row after which user is locked
+		After uint `toml:"after"`
+		// Base is lockout time in seconds; it's
+		// doubled by every next wrong password
+		Base uint `toml:"base"`
+		// Max is max lockout time in seconds
+		Max uint `toml:"max"`
+	} `toml:"lockout"`
+}
+
+// defaultRoutesLimits are used for routes
+// which aren't in [ratelimit.routes]
+var defaultRoutesLimits = map[string]rateConf{
+	"/reg":          {Rate: 0.05, Burst: 3},
+	"/get_token":    {Rate: 0.2, Burst: 10},
+	"/send_message": {Rate: 5, Burst: 20},
+}
+
+func checkRateConf(c *rateConf, name string, def rateConf) error {
+	if c.Rate < 0 {
+		return fmt.Errorf("%s.rate should be positive", name)
+	} else if c.Rate == 0 {
+		*c = def
+	} else if c.Burst == 0 {
+		c.Burst = uint(math.Ceil(c.Rate))
+	}
+	return nil
+}
+
+// checkRateLimitConf sets defaults of [ratelimit] section
+func checkRateLimitConf(c *rateLimitConf) error {
+	if err := checkRateConf(&c.IP, "ratelimit.ip", rateConf{20, 60}); err != nil {
+		return err
+	}
+	if err := checkRateConf(&c.Token, "ratelimit.token", rateConf{10, 30}); err != nil {
+		return err
+	}
+	if c.Routes == nil {
+		c.Routes = make(map[string]rateConf)
+	}
+	for route, rc := range defaultRoutesLimits {
+		if _, ok := c.Routes[route]; !ok {
+			c.Routes[route] = rc
+		}
+	}
+	for route, rc := range c.Routes {
+		if err := checkRateConf(&rc, "ratelimit.routes."+route, rateConf{}); err != nil {
+			return err
+		} else if rc.Rate == 0 {
+			return fmt.Errorf("ratelimit.routes.%s.rate is empty", route)
+		}
+		c.Routes[route] = rc
+	}
+	if c.Lockout.After == 0 {
+		c.Lockout.After = 5
+	}
+	if c.Lockout.Base == 0 {
+		c.Lockout.Base = 1
+	}
+	if c.Lockout.Max == 0 {
+		c.Lockout.Max = 15 * 60
+	}
+	return nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is set of token buckets by key.
+// It's safe for concurrent use
+type limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newLimiter(c rateConf) *limiter {
+	return &limiter{
+		rate:    c.Rate,
+		burst:   float64(c.Burst),
+		buckets: make(map[string]*bucket),
+		swept:   time.Now(),
+	}
+}
+
+// Allow takes token from bucket of key; if it's
+// empty, it returns time after which it won't be
+func (l *limiter) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes buckets which are full again,
+// so map doesn't grow forever
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// limiters are created by initLimiters
+var limiters struct {
+	ip, token *limiter
+	routes    map[string]*limiter
+}
+
+func initLimiters(c rateLimitConf) {
+	limiters.ip = newLimiter(c.IP)
+	limiters.token = newLimiter(c.Token)
+	limiters.routes = make(map[string]*limiter, len(c.Routes))
+	for route, rc := range c.Routes {
+		limiters.routes[route] = newLimiter(rc)
+	}
+}
+
+// remoteIP returns IP of request without port
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// routeKey returns key of route bucket: it's session if
+// token is valid one, else random tokens would give
+// new buckets to anyone, so it's IP then
+func routeKey(r *http.Request, token, ipKey string) string {
+	if token == "" || !isValidUUID(token) {
+		return ipKey
+	}
+	s, ok, err := checkSession(token)
+	if err != nil {
+		reqLog(r).Error("checking session", "err", err)
+		return ipKey
+	} else if !ok {
+		return ipKey
+	}
+	return "session:" + s.ID
+}
+
+// rateLimit checks limits of request and writes 429
+// answer if any is exceeded; it returns false then
+func rateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if conf.RateLimit.Disabled {
+		return true
+	}
+	ipKey := "ip:" + remoteIP(r)
+	ok, retry := limiters.ip.Allow(ipKey)
+	// token isn't checked here, so
+	// only its hash is used as key
+	token := strings.TrimSpace(r.Header.Get("Auth-Token"))
+	if ok && token != "" {
+		ok, retry = limiters.token.Allow("session:" + sessionID(token))
+	}
+	if l, found := limiters.routes[apiRoute(r.URL.Path)]; ok && found {
+		ok, retry = l.Allow(routeKey(r, token, ipKey))
+	}
+	if !ok {
+		tooManyRequests(w, retry, Answer{false, codeRateLimited, "Too many requests", nil})
+	}
+	return ok
+}
+
+// tooManyRequests writes 429 answer with Retry-After
+func tooManyRequests(w http.ResponseWriter, retry time.Duration, ans Answer) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	w.WriteHeader(429)
+	writeAnswer(w, ans)
+}
+
+// allowCommand checks limit of TCP commands of session
+func allowCommand(sessID string) bool {
+	if conf.RateLimit.Disabled {
+		return true
+	}
+	ok, _ := limiters.token.Allow("session:" + sessID)
+	return ok
+}
+
+// lockouts counts wrong passwords in a row by user id
+var lockouts = struct {
+	sync.Mutex
+	m map[string]*lockout
+}{m: make(map[string]*lockout)}
+
+type lockout struct {
+	fails uint
+	until time.Time
+}
+
+// lockedOut tells how long user with
+// id can't try password any more
+func lockedOut(userID string) time.Duration {
+	lockouts.Lock()
+	defer lockouts.Unlock()
+	if lo, ok := lockouts.m[userID]; ok {
+		if left := time.Until(lo.until); left > 0 {
+			return left
+		}
+	}
+	return 0
+}
+
+// passFailed counts wrong password of user; after
+// Lockout.After ones user is locked out for
+// Lockout.Base seconds doubled by every next one
+func passFailed(userID string) {
+	lockouts.Lock()
+	defer lockouts.Unlock()
+	lo, ok := lockouts.m[userID]
+	if !ok {
+		lo = &lockout{}
+		lockouts.m[userID] = lo
+	}
+	lo.fails++
+	c := conf.RateLimit.Lockout
+	if lo.fails < c.After {
+		return
+	}
+	d := time.Duration(c.Max) * time.Second
+	// power is limited, so it doesn't overflow
+	if n := lo.fails - c.After; n < 32 {
+		d = time.Duration(math.Min(float64(c.Base)*math.Pow(2, float64(n)), float64(c.Max))) * time.Second
+	}
+	lo.until = time.Now().Add(d)
+}
+
+// passSucceeded resets counter of wrong passwords
+func passSucceeded(userID string) {
+	lockouts.Lock()
+	defer lockouts.Unlock()
+	delete(lockouts.m, userID)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sessionID returns id of session with this token.
+// Only hash of token is stored, so leaked db
+// doesn't leak tokens
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newSession creates new session for user
+// and returns its token
+func newSession(userID string, r *http.Request) (string, error) {
+	token := uuid.New().String()
+	now := time.Now()
+	err := store.CreateSession(Session{
+		ID:        sessionID(token),
+		UserID:    userID,
+		Created:   now,
+		Expires:   now.Add(time.Duration(conf.Sessions.TTL) * time.Second),
+		LastUsed:  now,
+		UserAgent: r.Header.Get("User-Agent"),
+		IP:        remoteIP(r),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// checkSession returns session by its token and
+// updates its last_used; ok is false if session
+// doesn't exist or is expired
+func checkSession(token string) (Session, bool, error) {
+	return store.TouchSession(sessionID(token), time.Now())
+}
+
+// authorize checks Auth-Token header and writes
+// error answer if it's wrong
+func authorize(w http.ResponseWriter, r *http.Request) (Session, bool) {
+	token := strings.TrimSpace(r.Header.Get("Auth-Token"))
+	if token == "" {
+		w.WriteHeader(401)
+		writeAnswer(w, Answer{false, codeMissingToken, "Got no Auth-Token", nil})
+		return Session{}, false
+	} else if !isValidUUID(token) {
+		w.WriteHeader(400)
+		writeAnswer(w, Answer{false, codeInvalidToken, "Auth-Token is not valid", nil})
+		return Session{}, false
+	}
+	s, ok, err := checkSession(token)
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return Session{}, false
+	} else if !ok {
+		w.WriteHeader(401)
+		writeAnswer(w, Answer{false, codeInvalidToken, "Session not found or expired", nil})
+		return Session{}, false
+	}
+	return s, true
+}
+
+// SessionsHandler returns list of user's sessions
+func SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	cur, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	list, err := store.ListSessions(cur.UserID, time.Now())
+	if err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	}
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", SessionsResult{cur.ID, list}})
+}
+
+// RevokeSessionHandler revokes user's session by id
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		writeAnswer(w, Answer{false, codeMethodNotAllowed, "Unsupported method", nil})
+		return
+	}
+	cur, ok := authorize(w, r)
+	if !ok {
+		return
+	}
+	var req RevokeSessionRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if ok, err := store.DeleteSession(req.ID, cur.UserID); err != nil {
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return
+	} else if !ok {
+		w.WriteHeader(404)
+		writeAnswer(w, Answer{false, codeSessionNotFound, "Session with this id not found", nil})
+		return
+	}
+	// connection opened with revoked session
+	// shouldn't live any more
+	if c, ok := conns.Get(cur.UserID); ok && c.session == req.ID {
+		c.Write(Event{Type: evSessionRevoked}.ToJSON())
+		conns.Remove(cur.UserID, c)
+		c.Close()
+	}
+	w.WriteHeader(200)
+	writeAnswer(w, Answer{true, "", "", nil})
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shuttingDown is 1 after shutdown started
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// tcpListeners are closed on shutdown
+var tcpListeners struct {
+	sync.Mutex
+	l []net.Listener
+}
+
+func addTCPListener(ln net.Listener) {
+	tcpListeners.Lock()
+	tcpListeners.l = append(tcpListeners.l, ln)
+	tcpListeners.Unlock()
+}
+
+// sessionsWG waits for every accepted
+// connection to finish
+var sessionsWG sync.WaitGroup
+
+// sessionsMu makes check of shuttingDown and
+// sessionsWG.Add atomic, so Add can't be
+// called after shutdown started to Wait
+var sessionsMu sync.Mutex
+
+// trackConn adds accepted connection to sessionsWG;
+// it returns false if server is shutting down and
+// connection should be refused. Caller calls
+// sessionsWG.Done if it returns true
+func trackConn() bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if isShuttingDown() {
+		return false
+	}
+	sessionsWG.Add(1)
+	return true
+}
+
+// shutdown stops listeners, tells every connected
+// user that server is shutting down, waits for
+// their sessions and disconnects store. It gives
+// up waiting after conf.Shutdown.Timeout
+func shutdown(servers []*http.Server) {
+	sessionsMu.Lock()
+	started := atomic.CompareAndSwapInt32(&shuttingDown, 0, 1)
+	sessionsMu.Unlock()
+	if !started {
+		return
+	}
+	lg.Info("shutting down")
+	sctx, cancel := context.WithTimeout(ctx,
+		time.Duration(conf.Shutdown.Timeout)*time.Second)
+	defer cancel()
+	tcpListeners.Lock()
+	for _, ln := range tcpListeners.l {
+		ln.Close()
+	}
+	tcpListeners.Unlock()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(sctx); err != nil {
+				lg.Error("shutting down http server", "addr", srv.Addr, "err", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	// Write waits for pending writes, so event is written
+	// after them. Stuck client can hold it for writeTimeout,
+	// so writes are concurrent; sessions end after Close,
+	// and waiting for them is limited by sctx below
+	for _, c := range conns.All() {
+		go func(c *cConn) {
+			c.Write(Event{Type: evShutdown}.ToJSON())
+			c.Close()
+		}(c)
+	}
+	done := make(chan struct{})
+	go func() {
+		sessionsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-sctx.Done():
+		lg.Warn("sessions didn't finish before shutdown timeout")
+	}
+	if err := store.Close(sctx); err != nil {
+		lg.Error("closing store", "err", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTrackConnShutdown(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if trackConn() {
+				sessionsWG.Done()
+			}
+		}()
+	}
+	sessionsMu.Lock()
+	atomic.StoreInt32(&shuttingDown, 1)
+	sessionsMu.Unlock()
+	// Add can't happen after this Wait started
+	sessionsWG.Wait()
+	if trackConn() {
+		t.Fatal("connection is tracked after shutdown")
+	}
+	wg.Wait()
+}
+
+func TestShutdownStuckClient(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	// writeTimeout is longer than shutdown timeout
+	store = newMemStore()
+	conf.Shutdown.Timeout = 1
+	c := newCConn(&stuckConn{}, "s")
+	conns.Add("stuck", c)
+	defer conns.Remove("stuck", c)
+	start := time.Now()
+	shutdown(nil)
+	if d := time.Since(start); d > 3*time.Second {
+		t.Fatalf("shutdown took %v with stuck client", d)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Store is storage of users and sessions.
+// Methods returning ok are false if
+// nothing was found
+type Store interface {
+	GetUserByName(name string) (us User, ok bool, err error)
+	GetUserByID(id string) (us User, ok bool, err error)
+	// ListUsers returns users whose names contain query
+	// ignoring case, sorted by name and starting after after
+	ListUsers(query, after string, limit int) ([]User, error)
+	CreateUser(us User) error
+	// SetUserHash sets password hash and
+	// removes legacy plaintext password
+	SetUserHash(id, hash string) error
+
+	CreateSession(s Session) error
+	// TouchSession returns not expired session by id
+	// and sets its last_used to now
+	TouchSession(id string, now time.Time) (s Session, ok bool, err error)
+	// ListSessions returns user's sessions
+	// that aren't expired at now
+	ListSessions(userID string, now time.Time) ([]Session, error)
+	DeleteSession(id, userID string) (ok bool, err error)
+
+	// QueueMessage saves message for offline user;
+	// ok is false if user already has max messages
+	QueueMessage(m QueuedMessage, max int) (ok bool, err error)
+	// QueuedMessages returns user's messages
+	// not expired at now, oldest first
+	QueuedMessages(to string, now time.Time) ([]QueuedMessage, error)
+	DeleteQueued(ids []string) error
+
+	SaveMessage(m StoredMessage) error
+	// DeleteMessage removes message from history; it's
+	// used when message couldn't be delivered nor queued
+	DeleteMessage(id string) error
+	// SetReceipt sets time of status ("delivered" or "read")
+	// of messages with ids sent to user, if it isn't set
+	// yet; read message is delivered too. It returns
+	// messages which were changed
+	SetReceipt(to string, ids []string, status string, t time.Time) ([]StoredMessage, error)
+	// History returns up to limit messages between users a and b
+	// with id less than before (if it isn't empty), newest first
+	History(a, b, before string, limit int) ([]StoredMessage, error)
+	// GroupHistory is same as History for group
+	GroupHistory(groupID, before string, limit int) ([]StoredMessage, error)
+
+	CreateGroup(g Group) error
+	GetGroup(id string) (g Group, ok bool, err error)
+	// UpdateGroup replaces group with g if its version
+	// is still g.Version; ok is false if group was
+	// changed or deleted since g was read
+	UpdateGroup(g Group) (ok bool, err error)
+	DeleteGroup(id string) error
+	// GroupsOf returns groups where user is member
+	GroupsOf(userID string) ([]Group, error)
+
+	SetLastSeen(userID string, t time.Time) error
+	// AddToList adds target to user's list; ok is
+	// false if list already has max users
+	AddToList(list, userID, targetID string, max int) (ok bool, err error)
+	RemoveFromList(list, userID, targetID string) error
+	// List returns ids of users in user's list
+	List(list, userID string) ([]string, error)
+	// ListedBy returns ids of users who have target in list
+	ListedBy(list, targetID string) ([]string, error)
+	InList(list, userID, targetID string) (bool, error)
+
+	SetUserRole(id, role string) error
+	SetUserDisabled(id string, disabled bool) error
+	// DeleteUser deletes user with sessions,
+	// queued messages and lists
+	DeleteUser(id string) error
+	DeleteSessions(userID string) error
+
+	AddAudit(e AuditEntry) error
+	// AuditLog returns entries with id less than
+	// before (if it's set), newest first
+	AuditLog(before string, limit int) ([]AuditEntry, error)
+
+	// Ping checks that store is available
+	Ping(ctx context.Context) error
+	// Close disconnects store on shutdown
+	Close(ctx context.Context) error
+}
+
+const (
+	storeMongo  = "mongo"
+	storeMemory = "memory"
+)
+
+// per-user lists of other users
+const (
+	listSubscriptions = "subscriptions"
+	listContacts      = "contacts"
+	listBlocked       = "blocked"
+)
@@ -1,27 +1,46 @@
 package main
 
 import (
-	"net"
+	jsoniter "github.com/json-iterator/go"
 	"time"
 )
 
-type cConn struct {
-	Conn net.Conn
-	last time.Time
-}
-
 // User is for users in db
 type User struct {
-	Name  string `bson:"name"`
-	Pass  string `bson:"pass"`
-	Token string `bson:"_id"`
+	Name string `bson:"name"`
+	// Pass is legacy plaintext password;
+	// it's replaced by Hash on next login
+	Pass     string     `bson:"pass,omitempty"`
+	Hash     string     `bson:"hash,omitempty"`
+	ID       string     `bson:"_id"`
+	LastSeen *time.Time `bson:"last_seen,omitempty"`
+	// Role is userRoleAdmin for admins
+	// and empty for other users
+	Role string `bson:"role,omitempty"`
+	// Disabled users can't get tokens
+	Disabled bool `bson:"disabled,omitempty"`
+}
+
+// Session is for user's sessions in db
+type Session struct {
+	// ID is hash of session's token
+	ID        string    `bson:"_id" json:"id"`
+	UserID    string    `bson:"user_id" json:"-"`
+	Created   time.Time `bson:"created_at" json:"created_at"`
+	Expires   time.Time `bson:"expires_at" json:"expires_at"`
+	LastUsed  time.Time `bson:"last_used" json:"last_used"`
+	UserAgent string    `bson:"user_agent" json:"user_agent"`
+	IP        string    `bson:"ip" json:"ip"`
 }
 
 // Answer is type for JSON answer
 type Answer struct {
-	Success bool   `json:"succes"`
-	Error   string `json:"error,omitempty"`
-	Res     Result `json:"result,omitempty"`
+	Success bool `json:"succes"`
+	// Code is machine-readable code of error; it's
+	// written only to /v1 routes (see writeAnswer)
+	Code  string `json:"-"`
+	Error string `json:"error,omitempty"`
+	Res   Result `json:"result,omitempty"`
 }
 
 // Result needs to use
@@ -35,7 +54,7 @@ type Result interface {
 func (a Answer) ToJSON() []byte {
 	res, err := json.Marshal(a)
 	if err != nil {
-		errl.Println("answer2json: ", err)
+		lg.Error("answer2json", "err", err)
 		return []byte(`{"succes":false,"error":"server error"}`)
 	}
 	return res
@@ -49,10 +68,39 @@ type TokenResult struct {
 // Result method for Result interface
 func (TokenResult) Result() {}
 
+// SessionsResult is result for sessions
+type SessionsResult struct {
+	Current  string    `json:"current"`
+	Sessions []Session `json:"sessions"`
+}
+
+// Result method for Result interface
+func (SessionsResult) Result() {}
+
+// SendMessageResult is result for send_message
+type SendMessageResult struct {
+	// Status is "delivered" if message was written
+	// to peer's connection or "queued" if peer is
+	// offline and will get it on reconnect.
+	// It's "sent" for messages to groups
+	Status string `json:"status"`
+	// Delivered is count of online group
+	// members who got message
+	Delivered int `json:"delivered,omitempty"`
+	// dropped is true if sender is blocked
+	// by peer; it's not told to sender
+	dropped bool
+}
+
+// Result method for Result interface
+func (SendMessageResult) Result() {}
+
 // IsOnlineResult is result for IsOnline
 type IsOnlineResult struct {
 	Is     bool `json:"is"`
 	Exists bool `json:"exists"`
+	// LastSeen is set if user is offline
+	LastSeen *time.Time `json:"last_seen,omitempty"`
 }
 
 // Result method for Result interface
@@ -60,10 +108,13 @@ func (IsOnlineResult) Result() {}
 
 // Message is message.
 type Message struct {
-	From    string `json:"from_name"`
-	Message string `json:"message"`
-	Error   string `json:"error,omitempty"`
-	Type    string `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	From    string    `json:"from_name"`
+	Group   string    `json:"group_id,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error,omitempty"`
+	Type    string    `json:"type"`
 }
 
 // ToJSON returns encoded message
@@ -72,18 +123,365 @@ func (m Message) ToJSON() []byte {
 	m.Type = "message"
 	res, err := json.Marshal(m)
 	if err != nil {
-		infl.Println("[ERROR] message2json: ", err)
+		lg.Error("message2json", "err", err)
 		return []byte(`{"type":"message","error":"Error of encoding"}` + "\n")
 	}
 	return append(res, '\n')
 }
 
+// StoredMessage is for message history in db
+type StoredMessage struct {
+	ID       string    `bson:"_id" json:"id"`
+	From     string    `bson:"from" json:"-"`
+	To       string    `bson:"to" json:"-"`
+	FromName string    `bson:"from_name" json:"from_name"`
+	ToName   string    `bson:"to_name,omitempty" json:"to_name,omitempty"`
+	Group    string    `bson:"group,omitempty" json:"group_id,omitempty"`
+	Message  string    `bson:"message" json:"message"`
+	Created  time.Time `bson:"created_at" json:"time"`
+	// receipts are set by recipient;
+	// there are no ones in groups
+	Delivered *time.Time `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+	Read      *time.Time `bson:"read_at,omitempty" json:"read_at,omitempty"`
+}
+
+// HistoryResult is result for history
+type HistoryResult struct {
+	Messages []StoredMessage `json:"messages"`
+	// Next is value of before parameter
+	// for getting next page
+	Next string `json:"next,omitempty"`
+}
+
+// Result method for Result interface
+func (HistoryResult) Result() {}
+
+// QueuedMessage is for messages to
+// offline users in db
+type QueuedMessage struct {
+	ID      string    `bson:"_id"`
+	To      string    `bson:"to"`
+	From    string    `bson:"from_name"`
+	Message string    `bson:"message"`
+	Created time.Time `bson:"created_at"`
+	Expires time.Time `bson:"expires_at"`
+}
+
+// Receipt is event sent to sender of
+// message when recipient acknowledges it
+type Receipt struct {
+	Type string `json:"type"`
+	// ID is id of message
+	ID     string    `json:"id"`
+	Peer   string    `json:"peer_name"`
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+// ToJSON returns encoded receipt
+// as bytes
+func (r Receipt) ToJSON() []byte {
+	r.Type = "receipt"
+	res, err := json.Marshal(r)
+	if err != nil {
+		lg.Error("receipt2json", "err", err)
+		return []byte(`{"type":"receipt","error":"Error of encoding"}` + "\n")
+	}
+	return append(res, '\n')
+}
+
+// ListRequest is for getting data from requests
+// and commands adding users to lists or removing
+// from them (subscribe, add_contact, block etc.)
+type ListRequest struct {
+	Name string `json:"name" validate:"required"`
+}
+
+// UsersResult is result for contacts and blocked
+type UsersResult struct {
+	Users []string `json:"users"`
+}
+
+// Result method for Result interface
+func (UsersResult) Result() {}
+
+// Presence is presence of user
+type Presence struct {
+	Name   string `json:"name"`
+	Online bool   `json:"online"`
+	// LastSeen is set if user is offline
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// Result method for Result interface
+func (Presence) Result() {}
+
+// SubscriptionsResult is result for subscriptions
+type SubscriptionsResult struct {
+	Users []Presence `json:"users"`
+}
+
+// Result method for Result interface
+func (SubscriptionsResult) Result() {}
+
+// TypingRequest is for getting data
+// from typing request and command
+type TypingRequest struct {
+	PeerName string `json:"peer_name" validate:"unless=group_id,notblank"`
+	GroupID  string `json:"group_id,omitempty"`
+	Typing   bool   `json:"typing"`
+}
+
+// TypingResult is result for typing
+type TypingResult struct {
+	// Sent is false if event
+	// was dropped by throttling
+	Sent bool `json:"sent"`
+}
+
+// Result method for Result interface
+func (TypingResult) Result() {}
+
+// AckRequest is for getting data
+// from ack request and command
+type AckRequest struct {
+	// IDs are ids of messages
+	IDs []string `json:"ids" validate:"required,max=100"`
+	// Status is "delivered" or "read"
+	Status string `json:"status" validate:"oneof=delivered read"`
+}
+
 // SendMessageRequest is for
 // getting data from SendMessage
 // request
 // I added this because
 // it can have a lot of values
 type SendMessageRequest struct {
-	PeerName string `json:"peer_name"`
-	Message  string `json:"message"`
+	PeerName string `json:"peer_name" validate:"unless=group_id,notblank"`
+	// GroupID is set instead of
+	// PeerName for group messages
+	GroupID string `json:"group_id,omitempty"`
+	Message string `json:"message" validate:"notblank,max=1024"`
+}
+
+// RevokeSessionRequest is for
+// getting data from RevokeSession
+// request
+type RevokeSessionRequest struct {
+	ID string `json:"id" validate:"trim,required"`
+}
+
+// IsOnlineRequest is for
+// getting data from is_online
+// TCP command
+type IsOnlineRequest struct {
+	Name string `json:"name" validate:"trim,required"`
+}
+
+// AuthRequest is body of
+// get_token request
+type AuthRequest struct {
+	Name string `json:"name" validate:"trim,required"`
+	Pass string `json:"pass" validate:"required"`
+}
+
+// RegRequest is body of reg request
+type RegRequest struct {
+	Name string `json:"name" validate:"trim,required,min=4,max=32,charset=name"`
+	Pass string `json:"pass" validate:"required,max=31"`
+}
+
+// Command is command sent by client over TCP
+// after token, one JSON object per line
+type Command struct {
+	// ID is set by client and
+	// copied to reply as is
+	ID   string              `json:"id"`
+	Cmd  string              `json:"cmd"`
+	Args jsoniter.RawMessage `json:"args,omitempty"`
+}
+
+// Reply is answer to Command
+type Reply struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Answer
+}
+
+// ToJSON returns encoded reply
+// as bytes
+func (r Reply) ToJSON() []byte {
+	r.Type = "reply"
+	res, err := json.Marshal(r)
+	if err != nil {
+		lg.Error("reply2json", "err", err)
+		return []byte(`{"type":"reply","succes":false,"error":"server error"}` + "\n")
+	}
+	return append(res, '\n')
+}
+
+// Group is for group conversations in db
+type Group struct {
+	ID      string        `bson:"_id" json:"id"`
+	Name    string        `bson:"name" json:"name"`
+	Created time.Time     `bson:"created_at" json:"created_at"`
+	Members []GroupMember `bson:"members" json:"members"`
+	// Version is increased by every update; update
+	// of group changed since it was read fails
+	Version int64 `bson:"version" json:"-"`
+}
+
+// GroupMember is member of Group
+type GroupMember struct {
+	UserID string `bson:"user_id" json:"-"`
+	Name   string `bson:"name" json:"name"`
+	// Role is "owner", "admin" or "member"
+	Role string `bson:"role" json:"role"`
+}
+
+// GroupResult is result for group methods
+type GroupResult struct {
+	Group Group `json:"group"`
+}
+
+// Result method for Result interface
+func (GroupResult) Result() {}
+
+// GroupsResult is result for groups
+type GroupsResult struct {
+	Groups []Group `json:"groups"`
+}
+
+// Result method for Result interface
+func (GroupsResult) Result() {}
+
+// CreateGroupRequest is for
+// getting data from create_group
+// request
+type CreateGroupRequest struct {
+	Name string `json:"name" validate:"trim,required,max=64"`
+	// Members are names of users
+	// to add to group
+	Members []string `json:"members"`
+}
+
+// GroupRequest is for getting
+// data from leave_group request
+type GroupRequest struct {
+	GroupID string `json:"group_id"`
+}
+
+// GroupMemberRequest is for getting
+// data from group_invite and
+// group_remove requests
+type GroupMemberRequest struct {
+	GroupID string `json:"group_id"`
+	Name    string `json:"name"`
+}
+
+// RenameGroupRequest is for getting
+// data from rename_group request
+type RenameGroupRequest struct {
+	GroupID string `json:"group_id"`
+	Name    string `json:"name" validate:"trim,required,max=64"`
 }
+
+// GroupRoleRequest is for getting
+// data from group_role request
+type GroupRoleRequest struct {
+	GroupID string `json:"group_id"`
+	Name    string `json:"name"`
+	Role    string `json:"role"`
+}
+
+// CheckResult is result of one readiness check
+type CheckResult struct {
+	OK        bool    `json:"ok"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthResult is result for /healthz and /readyz
+type HealthResult struct {
+	Uptime int64                  `json:"uptime"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Result method for Result interface
+func (HealthResult) Result() {}
+
+// AuditEntry is admin action in audit log
+type AuditEntry struct {
+	ID        string    `bson:"_id" json:"id"`
+	AdminID   string    `bson:"admin_id" json:"-"`
+	AdminName string    `bson:"admin_name" json:"admin_name"`
+	Action    string    `bson:"action" json:"action"`
+	TargetID  string    `bson:"target_id" json:"-"`
+	Target    string    `bson:"target" json:"target"`
+	Details   string    `bson:"details,omitempty" json:"details,omitempty"`
+	Time      time.Time `bson:"time" json:"time"`
+}
+
+// AdminUser is user shown to admins
+type AdminUser struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Role     string     `json:"role,omitempty"`
+	Disabled bool       `json:"disabled,omitempty"`
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// AdminUsersRequest is for getting data from /admin/users
+type AdminUsersRequest struct {
+	// Query is part of name; empty one matches all
+	Query string `json:"query"`
+	// After is name after which list starts
+	After string `json:"after"`
+	Limit int    `json:"limit"`
+}
+
+// AdminUsersResult is result for /admin/users
+type AdminUsersResult struct {
+	Users []AdminUser `json:"users"`
+	// Next is value of after for next page
+	Next string `json:"next,omitempty"`
+}
+
+// Result method for Result interface
+func (AdminUsersResult) Result() {}
+
+// AdminUserRequest is for getting data from
+// admin requests about one user
+type AdminUserRequest struct {
+	Name string `json:"name" validate:"trim,required"`
+	// Pass is new password for reset_password;
+	// it's generated if empty
+	Pass string `json:"pass,omitempty" validate:"max=31"`
+	// Role is new role for set_role
+	Role string `json:"role,omitempty"`
+}
+
+// PassResult is result for /admin/reset_password
+type PassResult struct {
+	Pass string `json:"pass"`
+}
+
+// Result method for Result interface
+func (PassResult) Result() {}
+
+// AuditRequest is for getting data from /admin/audit
+type AuditRequest struct {
+	Before string `json:"before"`
+	Limit  int    `json:"limit"`
+}
+
+// AuditResult is result for /admin/audit
+type AuditResult struct {
+	Entries []AuditEntry `json:"entries"`
+	// Next is value of before for next page
+	Next string `json:"next,omitempty"`
+}
+
+// Result method for Result interface
+func (AuditResult) Result() {}
@@ -2,76 +2,240 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var tcpDeathChan = make(chan struct{})
-
 func tcpProcess(conn net.Conn) {
 	defer conn.Close()
-	token, err := bufio.NewReader(conn).ReadString('\n')
-	if err != nil {
-		fmt.Fprint(conn, "server-side error\n")
-		infl.Println("[ERROR] reading token", err)
+	if !trackConn() {
+		fmt.Fprint(conn, "server is shutting down\n")
 		return
 	}
-	token = strings.TrimSpace(token)
-	if len(token) == 0 {
-		fmt.Fprint(conn, "empty token\n")
+	defer sessionsWG.Done()
+	l := lg.With("conn_id", newCorrelationID(), "remote", conn.RemoteAddr())
+	// lines are limited like HTTP bodies, so client
+	// can't make server buffer endless line
+	lines := bufio.NewScanner(conn)
+	lines.Buffer(make([]byte, 0, 4096), maxBodySize)
+	readLine := func() (string, error) {
+		if lines.Scan() {
+			return lines.Text(), nil
+		} else if err := lines.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	// connection isn't in hub before auth, so
+	// reaper can't close silent one
+	conn.SetReadDeadline(time.Now().Add(time.Duration(conf.TCP.HeartbeatTimeout) * time.Second))
+	token, err := readLine()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		fmt.Fprint(conn, "token timeout\n")
+		l.Debug("no token before timeout")
 		return
-	} else if !isValidUUID(token) {
+	} else if err == bufio.ErrTooLong {
 		fmt.Fprint(conn, "invalid token\n")
+		l.Debug("too long token line")
 		return
-	} else if is, err := isInUsers(token); err != nil {
+	} else if err != nil {
 		fmt.Fprint(conn, "server-side error\n")
-		infl.Println("[ERROR] counting users", err)
+		l.Error("reading token", "err", err)
 		return
-	} else if !is {
-		fmt.Fprint(conn, "token not found")
+	}
+	sess, errText := connAuth(l, token)
+	if errText != "" {
+		fmt.Fprint(conn, errText+"\n")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	serveConn(l, sess, conn, readLine)
+}
+
+// connAuth checks token got from client on
+// connection; it returns text of error to
+// send to client if token is wrong
+func connAuth(l *logger, token string) (Session, string) {
+	token = strings.TrimSpace(token)
+	if len(token) == 0 {
+		return Session{}, "empty token"
+	} else if !isValidUUID(token) {
+		return Session{}, "invalid token"
+	}
+	sess, ok, err := checkSession(token)
+	if err != nil {
+		l.Error("checking session", "err", err)
+		return Session{}, "server-side error"
+	} else if !ok {
+		return Session{}, "token not found"
+	}
+	return sess, ""
+}
+
+// serveConn registers authorized connection, flushes
+// user's queue to it and executes commands got by readLine
+// until it fails. It's same for TCP and WebSocket
+func serveConn(l *logger, sess Session, conn io.WriteCloser, readLine func() (string, error)) {
+	l = l.With("user_id", sess.UserID)
+	us, found, err := store.GetUserByID(sess.UserID)
+	if err != nil || !found {
+		l.Error("getting user of session", "err", err)
+		fmt.Fprint(conn, "server-side error\n")
 		return
 	}
-	if _, ok := conns[token]; ok {
+	cc := newCConn(conn, sess.ID)
+	// messages sent while queue is flushing
+	// should be written after queued ones
+	cc.wmu.Lock()
+	if !conns.Add(sess.UserID, cc) {
+		cc.wmu.Unlock()
 		fmt.Fprint(conn, "you already have connection; destroy it using go_offline method\n")
 		return
 	}
-	conns[token] = cConn{
-		Conn: conn,
-		last: time.Now(),
+	l.Info("connected")
+	defer func() {
+		conns.Remove(sess.UserID, cc)
+		// connection could be already removed by
+		// reaper or go_offline, but not replaced
+		if _, ok := conns.Get(sess.UserID); !ok {
+			wentOffline(l, us)
+		}
+		l.Info("disconnected")
+	}()
+	fmt.Fprint(lockedConn{cc}, "success\n")
+	if err := flushQueue(sess.UserID, lockedConn{cc}); err != nil {
+		l.Error("flushing queue", "err", err)
 	}
-	fmt.Fprint(conn, "success\n")
-WAITER:
+	cc.wmu.Unlock()
+	notifyPresence(l, us, true)
+	// reading fails when client closes socket or
+	// connection is closed by reaper or go_offline;
+	// anything client sends counts as heartbeat
 	for {
-		cc, ok := conns[token]
-		if !ok {
-			break WAITER
-		} else if _, err := conn.Read([]byte{}); err != nil {
-			break WAITER
-		} else if time.Now().Sub(cc.last) <= 2*time.Minute {
-			break WAITER
+		line, err := readLine()
+		if err != nil {
+			return
+		}
+		cc.Beat()
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if !handleCommand(l, sess.UserID, cc, line) {
+			return
+		}
+	}
+}
+
+// handleCommand executes command got from user's
+// connection and writes reply to it; it returns
+// false if connection should be closed
+func handleCommand(l *logger, userID string, cc *cConn, line string) bool {
+	var cmd Command
+	if err := json.Unmarshal([]byte(line), &cmd); err != nil {
+		cc.Write(Reply{Answer: Answer{false, codeInvalidJSON, "Invalid JSON", nil}}.ToJSON())
+		return true
+	}
+	if !allowCommand(cc.session) {
+		cc.Write(Reply{ID: cmd.ID, Answer: Answer{false, codeRateLimited, "Too many requests", nil}}.ToJSON())
+		return true
+	}
+	var ans Answer
+	switch cmd.Cmd {
+	case "send":
+		var req SendMessageRequest
+		if ans = cmd.bind(&req); ans.Success {
+			_, ans = sendMessage(l, userID, req)
 		}
-		select {
-		case <-tcpDeathChan:
-			break WAITER
+	case "heartbeat":
+		// every line is heartbeat, so
+		// it's already done
+		ans = Answer{true, "", "", nil}
+	case "ack":
+		var req AckRequest
+		if ans = cmd.bind(&req); ans.Success {
+			_, ans = ack(l, userID, req)
 		}
+	case "typing":
+		var req TypingRequest
+		if ans = cmd.bind(&req); ans.Success {
+			_, ans = typing(l, userID, req)
+		}
+	case "subscribe", "unsubscribe":
+		var req ListRequest
+		if ans = cmd.bind(&req); ans.Success {
+			_, ans = subscribe(l, userID, req, cmd.Cmd == "subscribe")
+		}
+	case "is_online":
+		var req IsOnlineRequest
+		if ans = cmd.bind(&req); ans.Success {
+			_, ans = isOnline(l, userID, req.Name)
+		}
+	case "bye":
+		cc.Write(Reply{ID: cmd.ID, Answer: Answer{true, "", "", nil}}.ToJSON())
+		return false
+	case "":
+		ans = Answer{false, codeMissingField, "Got no cmd", nil}
+	default:
+		ans = Answer{false, codeUnknownCommand, "Unknown cmd", nil}
+	}
+	cc.Write(Reply{ID: cmd.ID, Answer: ans}.ToJSON())
+	return true
+}
+
+// bind decodes command's args to v and validates them;
+// it returns answer with error if it fails. TCP protocol
+// isn't versioned, so messages are like of old routes
+func (cmd Command) bind(v interface{}) Answer {
+	if len(cmd.Args) == 0 {
+		return Answer{false, codeMissingField, "Got no args", nil}
+	} else if err := json.Unmarshal(cmd.Args, v); err != nil {
+		return Answer{false, codeInvalidField, "Invalid args", nil}
 	}
-	delete(conns, token)
+	_, ans := validateLegacy(v)
+	return ans
 }
 
-func listenPort(p uint16) error {
+// reaper disconnects clients which
+// didn't send heartbeat for timeout
+func reaper(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		if n := conns.Reap(time.Now().Add(-timeout)); n != 0 {
+			lg.Info("reaped stale connections", "count", n)
+		}
+	}
+}
+
+// listenPort accepts TCP connections on port until
+// shutdown; they're wrapped in TLS if tlsConf isn't nil
+func listenPort(p uint16, tlsConf *tls.Config) error {
 	port := ":" + strconv.Itoa(int(p))
-	defer func() { tcpDeathChan <- struct{}{} }()
-	ln, err := net.Listen("tcp", port)
+	var (
+		ln  net.Listener
+		err error
+	)
+	if tlsConf != nil {
+		ln, err = tls.Listen("tcp", port, tlsConf)
+	} else {
+		ln, err = net.Listen("tcp", port)
+	}
 	if err != nil {
 		return err
 	}
+	addTCPListener(ln)
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			infl.Println("[ERROR] failed accepting of connection", err)
+			if isShuttingDown() {
+				return nil
+			}
+			lg.Error("accepting connection", "err", err)
 			continue
 		}
 		go tcpProcess(conn)
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// tlsConf is [http.tls] and [tcp.tls] sections of config.
+// TLS is enabled if Cert is not empty
+type tlsConf struct {
+	Port uint16 `toml:"port"`
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+	// ClientCA enables mTLS: clients should
+	// have certificate signed by it
+	ClientCA string `toml:"client_ca"`
+	// Only disables plain listener, when
+	// all clients use TLS
+	Only bool `toml:"only"`
+}
+
+// Enabled tells if TLS listener should be started
+func (c tlsConf) Enabled() bool {
+	return c.Cert != ""
+}
+
+// certReloader keeps certificate and client CA,
+// so they can be reloaded without restart
+type certReloader struct {
+	conf tlsConf
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	cas  *x509.CertPool
+}
+
+// certReloaders are reloaded on SIGHUP
+var certReloaders []*certReloader
+
+func newCertReloader(c tlsConf) (*certReloader, error) {
+	r := &certReloader{conf: c}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	certReloaders = append(certReloaders, r)
+	return r, nil
+}
+
+// Reload reads files again; old ones
+// are kept if it fails
+func (r *certReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.conf.Cert, r.conf.Key)
+	if err != nil {
+		return err
+	}
+	var cas *x509.CertPool
+	if r.conf.ClientCA != "" {
+		pem, err := ioutil.ReadFile(r.conf.ClientCA)
+		if err != nil {
+			return err
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.conf.ClientCA)
+		}
+	}
+	r.mu.Lock()
+	r.cert, r.cas = &cert, cas
+	r.mu.Unlock()
+	return nil
+}
+
+// Config returns TLS config which always
+// uses last loaded certificates
+func (r *certReloader) Config() *tls.Config {
+	getCert := func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.cert, nil
+	}
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCert,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			c := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: getCert,
+			}
+			if r.cas != nil {
+				c.ClientCAs = r.cas
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return c, nil
+		},
+	}
+}
+
+// reloadCerts reloads all certificates
+func reloadCerts() {
+	for _, r := range certReloaders {
+		if err := r.Reload(); err != nil {
+			lg.Error("reloading certificate", "cert", r.conf.Cert, "err", err)
+			continue
+		}
+		lg.Info("reloaded certificate", "cert", r.conf.Cert)
+	}
+}
+
+// checkTLSConf validates section and sets default port
+func checkTLSConf(c *tlsConf, name string, defPort uint16) error {
+	if !c.Enabled() {
+		if c.Only {
+			return errors.New(name + ".only is set, but " + name + ".cert is empty")
+		}
+		return nil
+	}
+	if c.Key == "" {
+		return errors.New(name + ".key is empty")
+	}
+	if c.Port == 0 {
+		c.Port = defPort
+	}
+	return nil
+}
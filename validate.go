@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxBodySize is max size of request body in bytes
+const maxBodySize = 64 << 10
+
+// charsets are named sets of symbols for charset rule
+var charsets = map[string]string{
+	"name": allowedSymbols,
+}
+
+// checker is request with rules which
+// can't be told by validate tags
+type checker interface {
+	Check() (int, Answer)
+}
+
+// legacyRule is rule of field of request type; rule
+// "type" is wrong type of field and "json" with empty
+// field is body which isn't JSON object
+type legacyRule struct {
+	req, field, rule string
+}
+
+// legacyMessages are messages of unversioned routes and TCP
+// commands made before validate. Their rules are same as of
+// /v1 routes, only messages of failed ones are different
+var legacyMessages = map[legacyRule]string{
+	{"RegRequest", "name", "type"}:     `"name" field is not string type`,
+	{"RegRequest", "name", "charset"}:  "Name contains not-allowed symbols. GET /allowed_syms to more ingo",
+	{"RegRequest", "pass", "type"}:     `"pass" field is not string type`,
+	{"RegRequest", "pass", "required"}: "pass should be longer",
+	{"RegRequest", "pass", "max"}:      "pass is TOO long",
+
+	{"AuthRequest", "name", "type"}:     "Got not-string name",
+	{"AuthRequest", "name", "required"}: "Got no name",
+	{"AuthRequest", "pass", "type"}:     "Got not-string pass",
+	{"AuthRequest", "pass", "required"}: "Got no pass",
+
+	{"AdminUserRequest", "pass", "max"}:        "pass is TOO long",
+	{"RevokeSessionRequest", "id", "required"}: "Empty id",
+
+	{"SendMessageRequest", "", "json"}:              "Invalid JSON",
+	{"SendMessageRequest", "peer_name", "notblank"}: "Empty peer_name",
+	{"SendMessageRequest", "message", "notblank"}:   "Empty message",
+	{"SendMessageRequest", "message", "max"}:        "Too long Message",
+	{"TypingRequest", "peer_name", "notblank"}:      "Empty peer_name",
+
+	{"AckRequest", "ids", "required"}: "Empty ids",
+	{"AckRequest", "status", "oneof"}: `status should be "delivered" or "read"`,
+
+	{"CreateGroupRequest", "name", "required"}: "Empty name",
+	{"RenameGroupRequest", "name", "required"}: "Empty name",
+}
+
+// legacyMessage returns message of failed rule
+// of field of v in legacyMessages or def
+func legacyMessage(v interface{}, field, rule, def string) string {
+	if msg, ok := legacyMessages[legacyRule{reflect.TypeOf(v).Elem().Name(), field, rule}]; ok {
+		return msg
+	}
+	return def
+}
+
+// readBody reads body of request; it
+// writes error answer if it fails
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			w.WriteHeader(413)
+			writeAnswer(w, Answer{false, codeBodyTooLarge, "Body is too large", nil})
+			return nil, false
+		}
+		w.WriteHeader(500)
+		reqLog(r).Error("server-side error", "err", err)
+		writeAnswer(w, Answer{false, codeInternal, "Server-side error", nil})
+		return nil, false
+	}
+	return body, true
+}
+
+// readJSON checks Content-Type of request, decodes its
+// body to v and validates it (see validate); it writes
+// error answer if it fails. Unversioned routes keep
+// old messages (see legacyMessages)
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(415)
+		writeAnswer(w, Answer{false, codeUnsupportedType, "Unsupported Content-Type", nil})
+		return false
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return false
+	}
+	var ans Answer
+	if len(strings.TrimSpace(string(body))) == 0 {
+		ans = Answer{false, codeEmptyBody, "Got no data", nil}
+	} else if err := json.Unmarshal(body, v); err != nil {
+		var field string
+		ans, field = typeError(v, body)
+		if !isV1(r) {
+			// old routes told about type only in some fields
+			if msg := legacyMessage(v, field, "type", ""); field != "" && msg != "" {
+				ans.Error = msg
+			} else {
+				ans = Answer{false, codeInvalidJSON, legacyMessage(v, "", "json", "Invalid JSON data"), nil}
+			}
+		}
+	} else {
+		check := validate
+		if !isV1(r) {
+			check = validateLegacy
+		}
+		var code int
+		if code, ans = check(v); !ans.Success {
+			w.WriteHeader(code)
+			writeAnswer(w, ans)
+			return false
+		}
+		return true
+	}
+	w.WriteHeader(400)
+	writeAnswer(w, ans)
+	return false
+}
+
+// typeError tells which field of v has wrong type in body
+// and returns its name, or returns common error if it
+// isn't about types
+func typeError(v interface{}, body []byte) (Answer, string) {
+	invalid := Answer{false, codeInvalidJSON, "Invalid JSON data", nil}
+	var m map[string]interface{}
+	t := reflect.TypeOf(v).Elem()
+	if json.Unmarshal(body, &m) != nil || t.Kind() != reflect.Struct {
+		return invalid, ""
+	}
+	for i := 0; i < t.NumField(); i++ {
+		name := fieldName(t.Field(i))
+		val, ok := m[name]
+		if !ok || val == nil {
+			continue
+		}
+		if want := jsonType(t.Field(i).Type); want != "" && want != jsonType(reflect.TypeOf(val)) {
+			return Answer{false, codeInvalidField, fmt.Sprintf("%q field is not %s type", name, want), nil}, name
+		}
+	}
+	return invalid, ""
+}
+
+// jsonType returns name of JSON type of values of t
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return ""
+}
+
+// fieldName returns name of field in JSON
+func fieldName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" {
+		return name
+	}
+	return f.Name
+}
+
+// validate checks fields of struct v points to by rules
+// of their validate tags and then calls Check if v has it.
+// Rules are comma separated:
+//
+//	trim       trims spaces of string before other rules
+//	unless=F   skips next rules if field F isn't empty
+//	required   string or slice is not empty
+//	notblank   string has not only spaces
+//	min=N      string has at least N symbols or slice N items
+//	max=N      string has at most N symbols or slice N items
+//	charset=S  string has only symbols of charsets[S]
+//	oneof=A B  string is one of space separated values
+func validate(v interface{}) (int, Answer) {
+	code, ans, _, _ := validateFields(v)
+	return code, ans
+}
+
+// validateLegacy is validate with messages of
+// unversioned routes (see legacyMessages)
+func validateLegacy(v interface{}) (int, Answer) {
+	code, ans, field, rule := validateFields(v)
+	if !ans.Success {
+		ans.Error = legacyMessage(v, field, rule, ans.Error)
+	}
+	return code, ans
+}
+
+// validateFields is validate which also returns
+// field and rule which failed
+func validateFields(v interface{}) (int, Answer, string, string) {
+	rv := reflect.ValueOf(v).Elem()
+	if rv.Kind() != reflect.Struct {
+		return 200, Answer{true, "", "", nil}, "", ""
+	}
+	for i := 0; i < rv.NumField(); i++ {
+		tag := rv.Type().Field(i).Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name := fieldName(rv.Type().Field(i))
+		if code, ans, rule := checkField(rv, i, name, strings.Split(tag, ",")); !ans.Success {
+			return code, ans, name, rule
+		}
+	}
+	if c, ok := v.(checker); ok {
+		code, ans := c.Check()
+		return code, ans, "", ""
+	}
+	return 200, Answer{true, "", "", nil}, "", ""
+}
+
+// checkField checks i-th field of struct sv by
+// rules; it returns rule which failed
+func checkField(sv reflect.Value, i int, name string, rules []string) (int, Answer, string) {
+	f := sv.Field(i)
+	var n int
+	switch f.Kind() {
+	case reflect.String:
+		n = len([]rune(f.String()))
+	case reflect.Slice:
+		n = f.Len()
+	default:
+		panic("validate tag on " + f.Kind().String() + " field " + name)
+	}
+	short, long := "Too short ", "Too long "
+	if f.Kind() == reflect.Slice {
+		short, long = "Too few ", "Too many "
+	}
+	for _, rule := range rules {
+		arg := ""
+		if i := strings.IndexByte(rule, '='); i != -1 {
+			rule, arg = rule[:i], rule[i+1:]
+		}
+		switch rule {
+		case "trim":
+			f.SetString(strings.TrimSpace(f.String()))
+			n = len([]rune(f.String()))
+		case "unless":
+			if !fieldByName(sv, arg).IsZero() {
+				return 200, Answer{true, "", "", nil}, ""
+			}
+		case "required":
+			if n == 0 {
+				return 400, Answer{false, codeMissingField, fmt.Sprintf("Got no %q field", name), nil}, rule
+			}
+		case "notblank":
+			if strings.TrimSpace(f.String()) == "" {
+				return 400, Answer{false, codeMissingField, fmt.Sprintf("Got no %q field", name), nil}, rule
+			}
+		case "min":
+			if n < mustAtoi(arg, name) {
+				return 400, Answer{false, codeTooShort, short + name, nil}, rule
+			}
+		case "max":
+			if n > mustAtoi(arg, name) {
+				return 413, Answer{false, codeTooLong, long + name, nil}, rule
+			}
+		case "charset":
+			set, ok := charsets[arg]
+			if !ok {
+				panic("unknown charset " + arg + " of field " + name)
+			}
+			for _, sym := range f.String() {
+				if !strings.ContainsRune(set, sym) {
+					return 400, Answer{false, codeInvalidCharset, capitalize(name) + " contains not-allowed symbols. GET /allowed_syms to more info", nil}, rule
+				}
+			}
+		case "oneof":
+			if !oneOf(f.String(), strings.Fields(arg)) {
+				return 400, Answer{false, codeInvalidField, fmt.Sprintf("%q should be %s", name, quoteOr(strings.Fields(arg))), nil}, rule
+			}
+		default:
+			panic("unknown rule " + rule + " of field " + name)
+		}
+	}
+	return 200, Answer{true, "", "", nil}, ""
+}
+
+// fieldByName returns field of struct sv by its name
+// in JSON; wrong names in tags are bugs, so it panics
+func fieldByName(sv reflect.Value, name string) reflect.Value {
+	for i := 0; i < sv.NumField(); i++ {
+		if fieldName(sv.Type().Field(i)) == name {
+			return sv.Field(i)
+		}
+	}
+	panic("unknown field " + name + " in validate tag")
+}
+
+func oneOf(s string, list []string) bool {
+	for _, elem := range list {
+		if s == elem {
+			return true
+		}
+	}
+	return false
+}
+
+// quoteOr joins quoted values like "a", "b" or "c"
+func quoteOr(list []string) string {
+	q := make([]string, len(list))
+	for i, s := range list {
+		q[i] = strconv.Quote(s)
+	}
+	if len(q) < 2 {
+		return strings.Join(q, "")
+	}
+	return strings.Join(q[:len(q)-1], ", ") + " or " + q[len(q)-1]
+}
+
+// mustAtoi parses argument of rule; wrong
+// tags are bugs, so it panics
+func mustAtoi(s, name string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		panic("wrong number in validate tag of field " + name)
+	}
+	return n
+}
+
+func capitalize(s string) string {
+	r := []rune(s)
+	if len(r) == 0 {
+		return s
+	}
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decode runs readJSON on body sent to path and
+// returns status and answer written by it
+func decode(path, body string, v interface{}) (int, string) {
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	var w http.ResponseWriter = rec
+	if isV1(r) {
+		w = &v1Writer{ResponseWriter: rec}
+	}
+	if readJSON(w, r, v) {
+		return 200, ""
+	}
+	return rec.Code, rec.Body.String()
+}
+
+func TestReadJSONLegacyMessages(t *testing.T) {
+	long := strings.Repeat("a", 32)
+	tests := []struct {
+		path, body string
+		v          interface{}
+		code       int
+		legacy, v1 string
+	}{
+		{"/reg", `{"pass":"pass"}`, &RegRequest{}, 400,
+			`Got no \"name\" field`, `Got no \"name\" field`},
+		{"/reg", `{"name":"user"}`, &RegRequest{}, 400,
+			"pass should be longer", `Got no \"pass\" field`},
+		{"/reg", `{"name":"user","pass":""}`, &RegRequest{}, 400,
+			"pass should be longer", `Got no \"pass\" field`},
+		{"/reg", `{"name":"user","pass":"` + long + `"}`, &RegRequest{}, 413,
+			"pass is TOO long", "Too long pass"},
+		{"/reg", `{"name":"us$er","pass":"pass"}`, &RegRequest{}, 400,
+			"more ingo", "more info"},
+		{"/reg", `{"name":"user","pass":5}`, &RegRequest{}, 400,
+			`\"pass\" field is not string type`, `\"pass\" field is not string type`},
+		{"/get_token", `{"pass":"pass"}`, &AuthRequest{}, 400,
+			"Got no name", `Got no \"name\" field`},
+		{"/get_token", `{"name":"user","pass":5}`, &AuthRequest{}, 400,
+			"Got not-string pass", `\"pass\" field is not string type`},
+		{"/revoke_session", `{"id":" "}`, &RevokeSessionRequest{}, 400,
+			"Empty id", `Got no \"id\" field`},
+		{"/send_message", `{"peer_name":5}`, &SendMessageRequest{}, 400,
+			`"error":"Invalid JSON"`, `\"peer_name\" field is not string type`},
+		{"/admin/reset_password", `{"name":"user","pass":"` + long + `"}`, &AdminUserRequest{}, 413,
+			"pass is TOO long", "Too long pass"},
+		{"/send_message", `{"message":"hi"}`, &SendMessageRequest{}, 400,
+			"Empty peer_name", `Got no \"peer_name\" field`},
+		{"/send_message", `{"group_id":"g","message":" "}`, &SendMessageRequest{}, 400,
+			"Empty message", `Got no \"message\" field`},
+		{"/send_message", `{"peer_name":"user","message":"` + strings.Repeat("a", 1025) + `"}`, &SendMessageRequest{}, 413,
+			"Too long Message", "Too long message"},
+		{"/ack", `{"ids":[],"status":"read"}`, &AckRequest{}, 400,
+			"Empty ids", `Got no \"ids\" field`},
+		{"/ack", `{"ids":["id"],"status":"seen"}`, &AckRequest{}, 400,
+			`status should be \"delivered\" or \"read\"`, `\"status\" should be \"delivered\" or \"read\"`},
+		{"/create_group", `{"name":" "}`, &CreateGroupRequest{}, 400,
+			"Empty name", `Got no \"name\" field`},
+		{"/rename_group", `{"name":"` + strings.Repeat("a", 65) + `"}`, &RenameGroupRequest{}, 413,
+			"Too long name", "Too long name"},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{tt.path, apiV1 + tt.path} {
+			want := tt.legacy
+			if isV1(httptest.NewRequest("POST", path, nil)) {
+				want = tt.v1
+			}
+			code, ans := decode(path, tt.body, tt.v)
+			if code != tt.code || !strings.Contains(ans, want) {
+				t.Errorf("%s %s = %d %s, want %d with %q", path, tt.body, code, ans, tt.code, want)
+			}
+		}
+	}
+}
+
+func TestReadJSONLegacyRules(t *testing.T) {
+	// both versions have same rules
+	var req IsOnlineRequest
+	for _, path := range []string{"/is_online", "/v1/is_online"} {
+		if code, _ := decode(path, `{"name":""}`, &req); code != 400 {
+			t.Fatalf("%s with empty name = %d, want 400", path, code)
+		}
+	}
+	var reg RegRequest
+	if code, ans := decode("/reg", `{"name":" user ","pass":"pass"}`, &reg); code != 200 || reg.Name != "user" {
+		t.Fatalf("/reg = %d %s, name %q", code, ans, reg.Name)
+	}
+}
+
+func TestBindLegacyMessages(t *testing.T) {
+	cmd := Command{Cmd: "send", Args: []byte(`{"peer_name":"user","message":""}`)}
+	if ans := cmd.bind(&SendMessageRequest{}); ans.Success || ans.Error != "Empty message" {
+		t.Fatalf("bind = %+v, want Empty message", ans)
+	}
+	cmd.Args = []byte(`{"group_id":"g","message":"hi"}`)
+	if ans := cmd.bind(&SendMessageRequest{}); !ans.Success {
+		t.Fatalf("bind of group message = %+v", ans)
+	}
+}
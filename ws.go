@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"time"
+)
+
+var upgrader = websocket.Upgrader{
+	// browser clients are served from other origins
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsConn writes every Write as separate
+// text frame, so frames are same as lines
+// of TCP connection
+type wsConn struct {
+	*websocket.Conn
+}
+
+func (c wsConn) Write(b []byte) (int, error) {
+	err := c.WriteMessage(websocket.TextMessage, bytes.TrimSuffix(b, []byte{'\n'}))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readLine returns next text frame
+func (c wsConn) readLine() (string, error) {
+	_, b, err := c.ReadMessage()
+	return string(b), err
+}
+
+// WSHandler is WebSocket transport for browser
+// clients. Protocol is same as TCP one: first
+// frame is token and every frame is one line
+func WSHandler(w http.ResponseWriter, r *http.Request) {
+	// hijacked connection isn't waited
+	// by http.Server.Shutdown
+	if !trackConn() {
+		w.WriteHeader(503)
+		writeAnswer(w, Answer{false, codeUnavailable, "Server is shutting down", nil})
+		return
+	}
+	defer sessionsWG.Done()
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// upgrader already answered with error
+		return
+	}
+	conn := wsConn{ws}
+	defer conn.Close()
+	// frames are limited like TCP lines
+	ws.SetReadLimit(maxBodySize)
+	// like in TCP, silent connection isn't
+	// in hub before auth, so it's timed out
+	ws.SetReadDeadline(time.Now().Add(time.Duration(conf.TCP.HeartbeatTimeout) * time.Second))
+	token, err := conn.readLine()
+	if err != nil {
+		return
+	}
+	l := reqLog(r)
+	sess, errText := connAuth(l, token)
+	if errText != "" {
+		conn.Write([]byte(errText))
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+	serveConn(l, sess, conn, conn.readLine)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWSFrameLimit(t *testing.T) {
+	conf.TCP.HeartbeatTimeout = 5
+	srv := httptest.NewServer(http.HandlerFunc(WSHandler))
+	defer srv.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	big := bytes.Repeat([]byte("x"), maxBodySize+1)
+	if err := ws.WriteMessage(websocket.TextMessage, big); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("read after too big frame: %v, want close %d", err, websocket.CloseMessageTooBig)
+	}
+}